@@ -28,6 +28,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
 	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 var logger *slog.Logger = nil
@@ -48,6 +49,8 @@ func startGRPCEndpoint() {
 	healthServer := health.NewServer()
 	healthgrpc.RegisterHealthServer(grpcServer, healthServer)
 	healthServer.SetServingStatus("health", healthgrpc.HealthCheckResponse_SERVING)
+	// lets bunny's grpc method probes find the message types for the health service
+	reflection.Register(grpcServer)
 	go func() {
 		err := grpcServer.Serve(listener)
 		logger.Error("Error while serving gRPC", "err", err)
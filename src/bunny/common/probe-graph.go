@@ -0,0 +1,28 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// the outcomes of a run of an egress probe
+const ProbeOutcomeSuccess string = "success"
+const ProbeOutcomeFailure string = "failure"
+
+// the probe wasn't run because a probe it depends on didn't succeed the last time it ran
+const ProbeOutcomeSkippedDependency string = "skipped_dependency"
+
+// an egress probe, the probes it depends on, and how it went the last time it ran
+type ProbeGraphNode struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"dependsOn"`
+	// empty until the probe has run
+	LastOutcome string     `json:"lastOutcome,omitempty"`
+	LastRunTime *time.Time `json:"lastRunTime,omitempty"`
+	// the dependency that caused the last run to be skipped
+	SkippedBecauseOf string `json:"skippedBecauseOf,omitempty"`
+}
+
+// written by egress when probes run and read by ingress for the probe graph endpoint
+var ProbeGraph []ProbeGraphNode = []ProbeGraphNode{}
+var ProbeGraphMutex sync.Mutex
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"bunny/config"
+	"errors"
+	"os"
+	"strings"
+)
+
+// the file is read each time that the secret is used so that rotated secrets are picked up
+func ReadSecret(secretConfig *config.SecretConfig) (string, error) {
+	if secretConfig == nil {
+		return "", nil
+	}
+	if secretConfig.File != nil && *secretConfig.File != "" {
+		data, err := os.ReadFile(*secretConfig.File)
+		if err != nil {
+			return "", err
+		}
+		// files often end with a newline that isn't part of the secret
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if secretConfig.Value != nil {
+		return *secretConfig.Value, nil
+	}
+	return "", errors.New("secret has neither value nor file")
+}
@@ -5,26 +5,76 @@ type EgressConfig struct {
 	InitialDelayMilliseconds int                 `yaml:"initialDelayMilliseconds"`
 	PeriodMilliseconds       int                 `yaml:"periodMilliseconds"`
 	TimeoutMilliseconds      int                 `yaml:"timeoutMilliseconds"`
+	ExecAllowlist            []string            `yaml:"execAllowlist"`
 }
 
 type EgressProbeConfig struct {
-	Name      string                   `yaml:"name"`
-	Metrics   EgressProbeMetricsConfig `yaml:"metrics"`
-	Exec      *ExecActionConfig        `yaml:"exec"`
-	GRPC      *GRPCActionConfig        `yaml:"grpc"`
-	HTTPGet   *HTTPGetActionConfig     `yaml:"httpGet"`
-	TCPSocket *TCPSocketActionConfig   `yaml:"tcpSocket"`
+	Name                     string                   `yaml:"name"`
+	Metrics                  EgressProbeMetricsConfig `yaml:"metrics"`
+	DependsOn                []string                 `yaml:"dependsOn"`
+	Retries                  int                      `yaml:"retries"`
+	RetryBackoffMilliseconds *int                     `yaml:"retryBackoffMilliseconds"`
+	Cgroup                   *CgroupActionConfig      `yaml:"cgroup"`
+	DNS                      *DNSActionConfig         `yaml:"dns"`
+	Exec                     *ExecActionConfig        `yaml:"exec"`
+	File                     *FileActionConfig        `yaml:"file"`
+	GRPC                     *GRPCActionConfig        `yaml:"grpc"`
+	HTTPGet                  *HTTPGetActionConfig     `yaml:"httpGet"`
+	ListenQueue              *ListenQueueActionConfig `yaml:"listenQueue"`
+	LogTail                  *LogTailActionConfig     `yaml:"logTail"`
+	Memcached                *MemcachedActionConfig   `yaml:"memcached"`
+	Postgres                 *PostgresActionConfig    `yaml:"postgres"`
+	Process                  *ProcessActionConfig     `yaml:"process"`
+	Redis                    *RedisActionConfig       `yaml:"redis"`
+	Scenario                 *ScenarioActionConfig    `yaml:"scenario"`
+	Scrape                   *ScrapeActionConfig      `yaml:"scrape"`
+	TCPSocket                *TCPSocketActionConfig   `yaml:"tcpSocket"`
+	UDPSocket                *UDPSocketActionConfig   `yaml:"udpSocket"`
+	WebSocket                *WebSocketActionConfig   `yaml:"websocket"`
 }
 
 type EgressProbeMetricsConfig struct {
 	Attempts     MetricsConfig `yaml:"attempts"`
 	ResponseTime MetricsConfig `yaml:"responseTime"`
 	Successes    MetricsConfig `yaml:"successes"`
+	ExitCodes    MetricsConfig `yaml:"exitCodes"`
+	// websocket probes only
+	CloseCodes        MetricsConfig `yaml:"closeCodes"`
+	PingRoundTripTime MetricsConfig `yaml:"pingRoundTripTime"`
+	// probes with dependsOn only
+	SkippedDependencies MetricsConfig `yaml:"skippedDependencies"`
+	// most useful for probes with retries
+	FirstTrySuccesses   MetricsConfig `yaml:"firstTrySuccesses"`
+	SuccessesAfterRetry MetricsConfig `yaml:"successesAfterRetry"`
+	RetriesExhausted    MetricsConfig `yaml:"retriesExhausted"`
 }
 
 type ExecActionConfig struct {
-	Command []string    `yaml:"command"`
-	Env     []EnvConfig `yaml:"env"`
+	Command          []string           `yaml:"command"`
+	Env              []EnvConfig        `yaml:"env"`
+	WorkingDir       *string            `yaml:"workingDir"`
+	SuccessExitCodes []int              `yaml:"successExitCodes"`
+	OutputLimitBytes *int               `yaml:"outputLimitBytes"`
+	OutputLabelBytes int                `yaml:"outputLabelBytes"`
+	Stdout           *ExecOutputConfig  `yaml:"stdout"`
+	RunAsUser        *int               `yaml:"runAsUser"`
+	RunAsGroup       *int               `yaml:"runAsGroup"`
+	RLimits          *ExecRLimitsConfig `yaml:"rlimits"`
+	ForwardOtelEnv   bool               `yaml:"forwardOtelEnv"`
+	SpansFD          *int               `yaml:"spansFileDescriptor"`
+	Expect           *[]ExpectConfig    `yaml:"expect"`
+}
+
+type ExecRLimitsConfig struct {
+	CPUSeconds  *uint64 `yaml:"cpuSeconds"`
+	MemoryBytes *uint64 `yaml:"memoryBytes"`
+	OpenFiles   *uint64 `yaml:"openFiles"`
+	Processes   *uint64 `yaml:"processes"`
+}
+
+type ExecOutputConfig struct {
+	RegEx    *string          `yaml:"regex"`
+	JSONPath []JSONPathConfig `yaml:"jsonPath"`
 }
 
 type EnvConfig struct {
@@ -33,14 +83,30 @@ type EnvConfig struct {
 }
 
 type GRPCActionConfig struct {
-	Port    int     `yaml:"port"`
-	Service *string `yaml:"service"`
+	Port       int               `yaml:"port"`
+	UnixSocket *string           `yaml:"unixSocket"`
+	Service    *string           `yaml:"service"`
+	Method     *GRPCMethodConfig `yaml:"method"`
+}
+
+type GRPCMethodConfig struct {
+	Name              string           `yaml:"name"`
+	Request           string           `yaml:"request"`
+	DescriptorSetFile *string          `yaml:"descriptorSetFile"`
+	StatusCode        *string          `yaml:"statusCode"`
+	JSONPath          []JSONPathConfig `yaml:"jsonPath"`
+}
+
+type JSONPathConfig struct {
+	Path  string `yaml:"path"`
+	RegEx string `yaml:"regex"`
 }
 
 type HTTPGetActionConfig struct {
 	Host        *string             `yaml:"host"`
 	HTTPHeaders []HTTPHeadersConfig `yaml:"httpHeaders"`
 	Port        int                 `yaml:"port"`
+	UnixSocket  *string             `yaml:"unixSocket"`
 	Path        string              `yaml:"path"`
 	Scheme      *string             `yaml:"scheme"`
 }
@@ -51,22 +117,274 @@ type HTTPHeadersConfig struct {
 }
 
 type TCPSocketActionConfig struct {
-	Port   int             `yaml:"port"`
-	Host   *string         `yaml:"service"`
-	Expect *[]ExpectConfig `yaml:"expect"`
+	Port       int             `yaml:"port"`
+	Host       *string         `yaml:"service"`
+	UnixSocket *string         `yaml:"unixSocket"`
+	TLS        *TLSConfig      `yaml:"tls"`
+	Expect     *[]ExpectConfig `yaml:"expect"`
+}
+
+type TLSConfig struct {
+	ServerName         *string `yaml:"serverName"`
+	CAFile             *string `yaml:"caFile"`
+	InsecureSkipVerify bool    `yaml:"insecureSkipVerify"`
 }
 
 type ExpectConfig struct {
-	Send    *SendStepConfig    `yaml:"send"`
-	Receive *ReceiveStepConfig `yaml:"receive"`
+	Send                *SendStepConfig    `yaml:"send"`
+	Receive             *ReceiveStepConfig `yaml:"receive"`
+	OneOf               *OneOfStepConfig   `yaml:"oneOf"`
+	StartTLS            *TLSConfig         `yaml:"starttls"`
+	TimeoutMilliseconds *int               `yaml:"timeoutMilliseconds"`
+	Optional            bool               `yaml:"optional"`
 }
 
 type SendStepConfig struct {
-	Text      string `yaml:"text"`
-	Delimiter string `yaml:"delimiter"`
+	Text         string              `yaml:"text"`
+	Delimiter    string              `yaml:"delimiter"`
+	Encoding     *string             `yaml:"encoding"`
+	LengthPrefix *LengthPrefixConfig `yaml:"lengthPrefix"`
 }
 
 type ReceiveStepConfig struct {
+	RegEx         string `yaml:"regex"`
+	MaxReads      *int   `yaml:"maxReads"`
+	FramingConfig `yaml:",inline"`
+}
+
+type OneOfStepConfig struct {
+	Branches      []ExpectBranchConfig `yaml:"branches"`
+	FramingConfig `yaml:",inline"`
+}
+
+type ExpectBranchConfig struct {
+	RegEx string         `yaml:"regex"`
+	Steps []ExpectConfig `yaml:"steps"`
+}
+
+type FramingConfig struct {
+	Delimiter      string              `yaml:"delimiter"`
+	Encoding       *string             `yaml:"encoding"`
+	Length         *int                `yaml:"length"`
+	LengthPrefix   *LengthPrefixConfig `yaml:"lengthPrefix"`
+	ReadLimitBytes *int                `yaml:"readLimitBytes"`
+}
+
+type LengthPrefixConfig struct {
+	Size           int    `yaml:"size"`
+	Endian         string `yaml:"endian"`
+	IncludesPrefix bool   `yaml:"includesPrefix"`
+}
+
+type UDPSocketActionConfig struct {
+	Host   *string          `yaml:"host"`
+	Port   int              `yaml:"port"`
+	Expect []DatagramConfig `yaml:"expect"`
+}
+
+type DatagramConfig struct {
+	Send                *DatagramSendConfig    `yaml:"send"`
+	Receive             *DatagramReceiveConfig `yaml:"receive"`
+	TimeoutMilliseconds *int                   `yaml:"timeoutMilliseconds"`
+}
+
+type DatagramSendConfig struct {
+	Text     string  `yaml:"text"`
+	Encoding *string `yaml:"encoding"`
+}
+
+type DatagramReceiveConfig struct {
+	RegEx    string  `yaml:"regex"`
+	Encoding *string `yaml:"encoding"`
+}
+
+type DNSActionConfig struct {
+	Name          string   `yaml:"name"`
+	Type          *string  `yaml:"type"`
+	Resolver      *string  `yaml:"resolver"`
+	Protocol      *string  `yaml:"protocol"`
+	RCode         *string  `yaml:"rcode"`
+	MinAnswers    *int     `yaml:"minAnswers"`
+	Addresses     []string `yaml:"addresses"`
+	RegEx         *string  `yaml:"regex"`
+	MinTTLSeconds *int     `yaml:"minTTLSeconds"`
+	MaxTTLSeconds *int     `yaml:"maxTTLSeconds"`
+}
+
+// where to connect to for probe actions that speak the protocol of a particular server (like redis)
+type ServerConfig struct {
+	Host       *string    `yaml:"host"`
+	Port       *int       `yaml:"port"`
+	UnixSocket *string    `yaml:"unixSocket"`
+	TLS        *TLSConfig `yaml:"tls"`
+}
+
+// secrets can be given directly or read from a file (such as a mounted Kubernetes Secret)
+type SecretConfig struct {
+	Value *string `yaml:"value"`
+	File  *string `yaml:"file"`
+}
+
+type RedisActionConfig struct {
+	ServerConfig `yaml:",inline"`
+	Username     *string                `yaml:"username"`
+	Password     *SecretConfig          `yaml:"password"`
+	Role         *string                `yaml:"role"`
+	Info         []FieldAssertionConfig `yaml:"info"`
+}
+
+type MemcachedActionConfig struct {
+	ServerConfig `yaml:",inline"`
+	Version      *string                `yaml:"version"`
+	Stats        []FieldAssertionConfig `yaml:"stats"`
+}
+
+type PostgresActionConfig struct {
+	ServerConfig `yaml:",inline"`
+	User         string        `yaml:"user"`
+	Database     *string       `yaml:"database"`
+	Password     *SecretConfig `yaml:"password"`
+	Query        *string       `yaml:"query"`
+	RegEx        *string       `yaml:"regex"`
+}
+
+type FieldAssertionConfig struct {
+	Name  string `yaml:"name"`
+	RegEx string `yaml:"regex"`
+}
+
+type WebSocketActionConfig struct {
+	Host         *string                `yaml:"host"`
+	HTTPHeaders  []HTTPHeadersConfig    `yaml:"httpHeaders"`
+	Port         int                    `yaml:"port"`
+	UnixSocket   *string                `yaml:"unixSocket"`
+	Path         string                 `yaml:"path"`
+	TLS          *TLSConfig             `yaml:"tls"`
+	Subprotocols []string               `yaml:"subprotocols"`
+	Expect       []WebSocketFrameConfig `yaml:"expect"`
+	Ping         bool                   `yaml:"ping"`
+	CloseCode    *int                   `yaml:"closeCode"`
+}
+
+type WebSocketFrameConfig struct {
+	Send                *WebSocketSendConfig    `yaml:"send"`
+	Receive             *WebSocketReceiveConfig `yaml:"receive"`
+	TimeoutMilliseconds *int                    `yaml:"timeoutMilliseconds"`
+}
+
+type WebSocketSendConfig struct {
+	Text     string  `yaml:"text"`
+	Encoding *string `yaml:"encoding"`
+	Binary   bool    `yaml:"binary"`
+}
+
+type WebSocketReceiveConfig struct {
+	RegEx    string  `yaml:"regex"`
+	Encoding *string `yaml:"encoding"`
+}
+
+type FileActionConfig struct {
+	Path               string  `yaml:"path"`
+	Exists             *bool   `yaml:"exists"`
+	MaxAgeMilliseconds *int    `yaml:"maxAgeMilliseconds"`
+	MinSizeBytes       *int64  `yaml:"minSizeBytes"`
+	MaxSizeBytes       *int64  `yaml:"maxSizeBytes"`
+	RegEx              *string `yaml:"regex"`
+	ReadLimitBytes     *int    `yaml:"readLimitBytes"`
+	MinFreeBytes       *uint64 `yaml:"minFreeBytes"`
+	MinFreeInodes      *uint64 `yaml:"minFreeInodes"`
+}
+
+type ProcessActionConfig struct {
+	CommandLineRegEx       *string  `yaml:"commandLineRegEx"`
+	MaxCPUPercent          *float64 `yaml:"maxCPUPercent"`
+	MaxResidentMemoryBytes *uint64  `yaml:"maxResidentMemoryBytes"`
+	MaxOpenFDs             *int32   `yaml:"maxOpenFDs"`
+	MaxThreads             *int32   `yaml:"maxThreads"`
+}
+
+type CgroupActionConfig struct {
+	Path                *string                `yaml:"path"`
+	MaxMemoryUsageRatio *float64               `yaml:"maxMemoryUsageRatio"`
+	MaxPressure         []CgroupPressureConfig `yaml:"maxPressure"`
+}
+
+type CgroupPressureConfig struct {
+	Resource string  `yaml:"resource"`
+	Kind     *string `yaml:"kind"`
+	Window   *string `yaml:"window"`
+	Percent  float64 `yaml:"percent"`
+}
+
+type ListenQueueActionConfig struct {
+	Port               int      `yaml:"port"`
+	Backlog            *uint64  `yaml:"backlog"`
+	MaxQueueRatio      *float64 `yaml:"maxQueueRatio"`
+	MaxListenOverflows *uint64  `yaml:"maxListenOverflows"`
+	MaxListenDrops     *uint64  `yaml:"maxListenDrops"`
+}
+
+type LogTailActionConfig struct {
+	Path           string                 `yaml:"path"`
+	FromStart      bool                   `yaml:"fromStart"`
+	ReadLimitBytes *int                   `yaml:"readLimitBytes"`
+	Counters       []LogTailCounterConfig `yaml:"counters"`
+}
+
+type LogTailCounterConfig struct {
+	Name      string `yaml:"name"`
 	RegEx     string `yaml:"regex"`
-	Delimiter string `yaml:"delimiter"`
+	MaxSeries *int   `yaml:"maxSeries"`
+}
+
+type ScrapeActionConfig struct {
+	Host                 *string             `yaml:"host"`
+	HTTPHeaders          []HTTPHeadersConfig `yaml:"httpHeaders"`
+	Port                 int                 `yaml:"port"`
+	UnixSocket           *string             `yaml:"unixSocket"`
+	Path                 *string             `yaml:"path"`
+	Scheme               *string             `yaml:"scheme"`
+	SampleLimit          *int                `yaml:"sampleLimit"`
+	BodySizeLimitBytes   *int                `yaml:"bodySizeLimitBytes"`
+	MetricRelabelConfigs []RelabelConfig     `yaml:"metricRelabelConfigs"`
+}
+
+// the same as a Prometheus relabel_config
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"sourceLabels"`
+	Separator    *string  `yaml:"separator"`
+	RegEx        *string  `yaml:"regex"`
+	Modulus      *uint64  `yaml:"modulus"`
+	TargetLabel  *string  `yaml:"targetLabel"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       *string  `yaml:"action"`
+}
+
+type ScenarioActionConfig struct {
+	Host           *string              `yaml:"host"`
+	Port           int                  `yaml:"port"`
+	UnixSocket     *string              `yaml:"unixSocket"`
+	Scheme         *string              `yaml:"scheme"`
+	ReadLimitBytes *int                 `yaml:"readLimitBytes"`
+	Steps          []ScenarioStepConfig `yaml:"steps"`
+}
+
+type ScenarioStepConfig struct {
+	Name              *string                 `yaml:"name"`
+	Method            *string                 `yaml:"method"`
+	Path              string                  `yaml:"path"`
+	HTTPHeaders       []HTTPHeadersConfig     `yaml:"httpHeaders"`
+	Body              *string                 `yaml:"body"`
+	ExpectStatusCodes []int                   `yaml:"expectStatusCodes"`
+	ExpectHeaders     []FieldAssertionConfig  `yaml:"expectHeaders"`
+	JSONPath          []JSONPathConfig        `yaml:"jsonPath"`
+	Extract           []ScenarioExtractConfig `yaml:"extract"`
+}
+
+// exactly one of JSONPath, Header, or RegEx is set
+type ScenarioExtractConfig struct {
+	Variable string  `yaml:"variable"`
+	JSONPath *string `yaml:"jsonPath"`
+	Header   *string `yaml:"header"`
+	RegEx    *string `yaml:"regex"`
 }
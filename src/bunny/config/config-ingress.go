@@ -14,6 +14,16 @@ type HTTPServerConfig struct {
 	OpenTelemetryMetricsPath      string         `yaml:"openTelemetryMetricsPath"`
 	PrometheusMetricsPath         string         `yaml:"prometheusMetricsPath"`
 	Health                        []HealthConfig `yaml:"health"`
+	Push                          *PushConfig    `yaml:"push"`
+	ProbeGraphPath                string         `yaml:"probeGraphPath"`
+}
+
+type PushConfig struct {
+	RemoteWritePath string        `yaml:"remoteWritePath"`
+	JSONPath        string        `yaml:"jsonPath"`
+	BearerToken     *SecretConfig `yaml:"bearerToken"`
+	MaxSeries       *int          `yaml:"maxSeries"`
+	MaxBodyBytes    *int          `yaml:"maxBodyBytes"`
 }
 
 type HealthConfig struct {
@@ -1,6 +1,7 @@
 package egress
 
 import (
+	"bunny/common"
 	"bunny/config"
 	"bunny/logging"
 	"log/slog"
@@ -10,7 +11,6 @@ import (
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
-	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -21,6 +21,7 @@ var ConfigStageChannel chan config.ConfigStage = make(chan config.ConfigStage, 1
 var ticker *time.Ticker = nil
 var initialDelayTime time.Time = time.Now()
 var egressConfig *config.EgressConfig = nil
+var signalsConfig *config.SignalsConfig = nil
 var probes []Probe = []Probe{}
 var meter *metric.Meter = nil
 var tracer *trace.Tracer = nil
@@ -65,6 +66,8 @@ func GoEgress(wg *sync.WaitGroup) {
 func updateConfig(bunnyConfig *config.BunnyConfig) {
 	logger.Info("received config update")
 	egressConfig = &bunnyConfig.Egress
+	// process probes find the app the same way that signals does
+	signalsConfig = &bunnyConfig.Signals
 
 	// wait until telemetry finishes processing its config
 	configStage, ok := <-ConfigStageChannel
@@ -82,15 +85,21 @@ func updateConfig(bunnyConfig *config.BunnyConfig) {
 	meter = &newMeter
 	newTracer := otel.GetTracerProvider().Tracer("bunny/egress")
 	tracer = &newTracer
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// the propagator (trace context and baggage) is set by telemetry, which exec probes use for their env vars
 
 	// process probe configs
 	probes = []Probe{}
 	timeout := time.Duration(egressConfig.TimeoutMilliseconds) * time.Millisecond
 	for _, egressProbeConfig := range egressConfig.Probes {
 		var newProbe *Probe = newProbe(&egressProbeConfig, timeout)
+		if newProbe == nil {
+			logger.Error("skipping probe with invalid config", "egressProbeConfig.Name", egressProbeConfig.Name)
+			continue
+		}
 		probes = append(probes, *newProbe)
 	}
+	probes = orderProbes(probes)
+	newProbeGraph(probes)
 
 	now := time.Now()
 	initialDelayTime = now.Add(time.Duration(egressConfig.InitialDelayMilliseconds) * time.Millisecond)
@@ -108,10 +117,23 @@ func updateConfig(bunnyConfig *config.BunnyConfig) {
 func performProbes(tickTime *time.Time) {
 	logger.Debug("tick received", "tickTime", tickTime)
 
+	// the probes are in dependency order, so a probe that's skipped is recorded before the probes that depend on it check it
 	for _, probe := range probes {
-		if probe.ProbeAction != nil {
-			probeAction := *probe.ProbeAction
-			probeAction.act(probe.Name, probe.AttemptsMetric, probe.ResponseTimeMetric, probe.SuccessesMetric)
+		if probe.ProbeAction == nil {
+			continue
+		}
+		dependency := failedDependency(&probe)
+		if dependency != "" {
+			skipProbe(&probe, dependency)
+			continue
 		}
+		// need to run this on a separate goroutine since the timeout could be greater than the period
+		go func() {
+			var outcome string = common.ProbeOutcomeFailure
+			if runProbe(&probe) {
+				outcome = common.ProbeOutcomeSuccess
+			}
+			recordProbeOutcome(probe.Name, outcome, "")
+		}()
 	}
 }
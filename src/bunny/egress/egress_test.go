@@ -0,0 +1,47 @@
+package egress
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// probe actions log and create spans, so the tests need a logger and a tracer (which don't output anything)
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	newTracer := noop.NewTracerProvider().Tracer("bunny/egress")
+	tracer = &newTracer
+	os.Exit(m.Run())
+}
+
+// starts a TCP server on localhost which handles each connection with handle, returning its port
+// the server is stopped when the test finishes
+func startFakeServer(t *testing.T, handle func(connection net.Conn)) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				handle(connection)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
@@ -0,0 +1,100 @@
+package egress
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// lets the expect steps talk to a program over its stdin and stdout as if they were a network connection
+// pipes created by os.Pipe support deadlines, so step timeouts work the same way as they do for sockets
+type PipeConnection struct {
+	// our ends of the pipes
+	stdoutReader *os.File
+	stdinWriter  *os.File
+	// the program's ends of the pipes, which we close once the program has started
+	stdinReader  *os.File
+	stdoutWriter *os.File
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func newPipeConnection() (*PipeConnection, error) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	return &PipeConnection{
+		stdoutReader: stdoutReader,
+		stdinWriter:  stdinWriter,
+		stdinReader:  stdinReader,
+		stdoutWriter: stdoutWriter,
+	}, nil
+}
+
+func (connection *PipeConnection) attach(cmd *exec.Cmd) {
+	cmd.Stdin = connection.stdinReader
+	cmd.Stdout = connection.stdoutWriter
+}
+
+// after the program has started, it has its own copies of its ends of the pipes
+// ours have to be closed so that we see the end of stdout when the program exits
+func (connection *PipeConnection) started() {
+	connection.stdinReader.Close()
+	connection.stdoutWriter.Close()
+}
+
+// closes stdin so that the program knows the conversation is over (most interactive programs exit when this happens)
+// and throws away anything else the program writes so that it doesn't block on a full pipe
+func (connection *PipeConnection) finish(deadline time.Time) {
+	connection.stdinWriter.Close()
+	connection.stdoutReader.SetReadDeadline(deadline)
+	go io.Copy(io.Discard, connection.stdoutReader)
+}
+
+func (connection *PipeConnection) Read(data []byte) (int, error) {
+	return connection.stdoutReader.Read(data)
+}
+
+func (connection *PipeConnection) Write(data []byte) (int, error) {
+	return connection.stdinWriter.Write(data)
+}
+
+func (connection *PipeConnection) Close() error {
+	connection.stdinReader.Close()
+	connection.stdoutWriter.Close()
+	connection.stdinWriter.Close()
+	return connection.stdoutReader.Close()
+}
+
+func (connection *PipeConnection) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (connection *PipeConnection) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (connection *PipeConnection) SetDeadline(deadline time.Time) error {
+	connection.stdinWriter.SetWriteDeadline(deadline)
+	return connection.stdoutReader.SetReadDeadline(deadline)
+}
+
+func (connection *PipeConnection) SetReadDeadline(deadline time.Time) error {
+	return connection.stdoutReader.SetReadDeadline(deadline)
+}
+
+func (connection *PipeConnection) SetWriteDeadline(deadline time.Time) error {
+	return connection.stdinWriter.SetWriteDeadline(deadline)
+}
@@ -0,0 +1,205 @@
+package egress
+
+import (
+	"bunny/config"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exec probes are run in their own process group (so that anything they start can be killed with them)
+// and, optionally, as a different user and with resource limits
+type ExecSandbox struct {
+	credential *syscall.Credential
+	rlimits    []ExecRLimit
+	executable string
+}
+
+type ExecRLimit struct {
+	name     string
+	resource int
+	value    uint64
+}
+
+// Go doesn't have a way to set the rlimits of a child process before it starts running
+// so when rlimits are needed, Bunny runs itself with this as the first argument
+// it then sets the rlimits on itself and replaces itself with the probe's program (see RunExecSandbox)
+const ExecSandboxArg string = "__bunny-exec-sandbox"
+
+// the syscall package doesn't define RLIMIT_NPROC
+const rlimitNProc int = 0x6
+
+// how long to wait for the program's output to be closed after it has been killed
+// this only matters if something it started has left the process group
+const execWaitDelay time.Duration = 100 * time.Millisecond
+
+var execRLimitResources map[string]int = map[string]int{
+	"cpu":    syscall.RLIMIT_CPU,
+	"memory": syscall.RLIMIT_AS,
+	"files":  syscall.RLIMIT_NOFILE,
+	"procs":  rlimitNProc,
+}
+
+func newExecSandbox(execActionConfig *config.ExecActionConfig) *ExecSandbox {
+	var credential *syscall.Credential = nil
+	if execActionConfig.RunAsUser != nil || execActionConfig.RunAsGroup != nil {
+		uid := os.Getuid()
+		if execActionConfig.RunAsUser != nil {
+			uid = *execActionConfig.RunAsUser
+		}
+		gid := os.Getgid()
+		if execActionConfig.RunAsGroup != nil {
+			gid = *execActionConfig.RunAsGroup
+		}
+		if uid < 0 || gid < 0 {
+			logger.Error("runAsUser and runAsGroup for exec action must not be negative", "uid", uid, "gid", gid)
+			return nil
+		}
+		// the supplementary groups of Bunny are dropped so that the program only has the group it was given
+		credential = &syscall.Credential{
+			Uid:    uint32(uid),
+			Gid:    uint32(gid),
+			Groups: []uint32{},
+		}
+	}
+
+	var rlimits []ExecRLimit = []ExecRLimit{}
+	if execActionConfig.RLimits != nil {
+		rlimitValues := map[string]*uint64{
+			"cpu":    execActionConfig.RLimits.CPUSeconds,
+			"memory": execActionConfig.RLimits.MemoryBytes,
+			"files":  execActionConfig.RLimits.OpenFiles,
+			"procs":  execActionConfig.RLimits.Processes,
+		}
+		for name, value := range rlimitValues {
+			if value != nil {
+				rlimits = append(rlimits, ExecRLimit{name: name, resource: execRLimitResources[name], value: *value})
+			}
+		}
+	}
+
+	var executable string = ""
+	if len(rlimits) > 0 {
+		var err error
+		executable, err = os.Executable()
+		if err != nil {
+			logger.Error("could not find Bunny's executable for setting rlimits on exec action", "err", err)
+			return nil
+		}
+	}
+
+	return &ExecSandbox{
+		credential: credential,
+		rlimits:    rlimits,
+		executable: executable,
+	}
+}
+
+// the allowlist is a list of paths (which can use the same patterns as filepath.Match) that commands must be in
+// an empty allowlist allows any command
+func checkExecAllowlist(path string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	if !filepath.IsAbs(path) {
+		logger.Error("commands must use absolute paths when execAllowlist is set", "path", path)
+		return false
+	}
+	cleanPath := filepath.Clean(path)
+	for _, allowed := range allowlist {
+		matched, err := filepath.Match(allowed, cleanPath)
+		if err != nil {
+			logger.Error("bad pattern in execAllowlist", "allowed", allowed, "err", err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	logger.Error("command is not in execAllowlist", "path", path)
+	return false
+}
+
+func (sandbox ExecSandbox) command(ctx context.Context, command []string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if len(sandbox.rlimits) == 0 {
+		cmd = exec.CommandContext(ctx, command[0], command[1:]...)
+	} else {
+		args := []string{ExecSandboxArg}
+		for _, rlimit := range sandbox.rlimits {
+			args = append(args, fmt.Sprintf("%v=%v", rlimit.name, rlimit.value))
+		}
+		args = append(args, "--")
+		args = append(args, command...)
+		cmd = exec.CommandContext(ctx, sandbox.executable, args...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: sandbox.credential,
+	}
+	// kill the whole process group rather than just the program we started
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = execWaitDelay
+	return cmd
+}
+
+// since the process group has the same ID as the program we started, this works even after the program has exited
+// as long as anything it started is still running
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// this is run in place of Bunny's main() when Bunny is started with ExecSandboxArg
+// it never returns - either the program replaces this process or this process exits
+func RunExecSandbox(args []string) {
+	separator := -1
+	for i, arg := range args {
+		if arg == "--" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || separator == len(args)-1 {
+		fmt.Fprintln(os.Stderr, "bunny exec sandbox: no command given")
+		os.Exit(126)
+	}
+	for _, arg := range args[:separator] {
+		name, valueString, _ := strings.Cut(arg, "=")
+		resource, found := execRLimitResources[name]
+		value, err := strconv.ParseUint(valueString, 10, 64)
+		if !found || err != nil {
+			fmt.Fprintln(os.Stderr, "bunny exec sandbox: bad rlimit", arg)
+			os.Exit(126)
+		}
+		err = syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bunny exec sandbox: could not set rlimit", arg, err)
+			os.Exit(126)
+		}
+	}
+	command := args[separator+1:]
+	// unlike exec.Command, syscall.Exec doesn't look in PATH, so it has to be done here
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny exec sandbox: could not find command", command[0], err)
+		os.Exit(127)
+	}
+	err = syscall.Exec(path, command, os.Environ())
+	fmt.Fprintln(os.Stderr, "bunny exec sandbox: could not run command", command[0], err)
+	os.Exit(127)
+}
@@ -0,0 +1,208 @@
+package egress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how much a program can write to the spans file descriptor
+const execSpansLimitBytes int64 = 1024 * 1024
+
+// Bunny's own exporter settings, so that they don't have to be repeated in the env of every probe
+func newExecOtelEnv() []string {
+	var env []string = []string{}
+	for _, envVar := range os.Environ() {
+		if strings.HasPrefix(envVar, "OTEL_") {
+			env = append(env, envVar)
+		}
+	}
+	return env
+}
+
+// the env vars that tell the program about the exec-probe span
+// TRACEPARENT, TRACESTATE, and BAGGAGE are what the OpenTelemetry SDKs (and otel-cli) look for when continuing a trace
+func newExecTraceContextEnv(ctx context.Context, span *trace.Span) []string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	var env []string = []string{}
+	for _, key := range carrier.Keys() {
+		env = append(env, strings.ToUpper(key)+"="+carrier.Get(key))
+	}
+	spanContext := (*span).SpanContext()
+	env = append(env,
+		// kept for otel-cli, which only used the trace ID before it supported TRACEPARENT
+		"OTEL_CLI_FORCE_TRACE_ID="+spanContext.TraceID().String(),
+		"BUNNY_SPAN_ID="+spanContext.SpanID().String(),
+	)
+	return env
+}
+
+// the OTLP/JSON encoding of traces - only the parts that we turn into spans are decoded
+// see: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpJSONTraces struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpJSONSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpJSONSpan struct {
+	SpanID            string             `json:"spanId"`
+	ParentSpanID      string             `json:"parentSpanId"`
+	Name              string             `json:"name"`
+	Kind              int                `json:"kind"`
+	StartTimeUnixNano otlpJSONInt        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpJSONInt        `json:"endTimeUnixNano"`
+	Attributes        []otlpJSONKeyValue `json:"attributes"`
+	Events            []struct {
+		Name         string             `json:"name"`
+		TimeUnixNano otlpJSONInt        `json:"timeUnixNano"`
+		Attributes   []otlpJSONKeyValue `json:"attributes"`
+	} `json:"events"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string      `json:"stringValue"`
+		BoolValue   *bool        `json:"boolValue"`
+		IntValue    *otlpJSONInt `json:"intValue"`
+		DoubleValue *float64     `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// 64 bit integers are strings in OTLP/JSON but some encoders write them as numbers
+type otlpJSONInt int64
+
+func (i *otlpJSONInt) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpJSONInt(value)
+	return nil
+}
+
+func (keyValue otlpJSONKeyValue) attribute() (attribute.KeyValue, bool) {
+	switch {
+	case keyValue.Value.StringValue != nil:
+		return attribute.String(keyValue.Key, *keyValue.Value.StringValue), true
+	case keyValue.Value.BoolValue != nil:
+		return attribute.Bool(keyValue.Key, *keyValue.Value.BoolValue), true
+	case keyValue.Value.IntValue != nil:
+		return attribute.Int64(keyValue.Key, int64(*keyValue.Value.IntValue)), true
+	case keyValue.Value.DoubleValue != nil:
+		return attribute.Float64(keyValue.Key, *keyValue.Value.DoubleValue), true
+	}
+	return attribute.KeyValue{}, false
+}
+
+func otlpJSONAttributes(keyValues []otlpJSONKeyValue) []attribute.KeyValue {
+	var attributes []attribute.KeyValue = []attribute.KeyValue{}
+	for _, keyValue := range keyValues {
+		if attribute, ok := keyValue.attribute(); ok {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// reads OTLP/JSON documents (one per line, as written by otel-cli and the OTLP file exporters) until the program closes the pipe
+func readExecSpans(reader *os.File, deadline time.Time) []otlpJSONSpan {
+	reader.SetReadDeadline(deadline)
+	var spans []otlpJSONSpan = []otlpJSONSpan{}
+	scanner := bufio.NewScanner(io.LimitReader(reader, execSpansLimitBytes))
+	scanner.Buffer(make([]byte, 64*1024), int(execSpansLimitBytes))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var traces otlpJSONTraces
+		err := json.Unmarshal(line, &traces)
+		if err != nil {
+			logger.Debug("could not parse otlp json from exec probe", "err", err)
+			continue
+		}
+		for _, resourceSpans := range traces.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+	}
+	if scanner.Err() != nil {
+		logger.Debug("stopped reading spans from exec probe", "err", scanner.Err())
+	}
+	return spans
+}
+
+// the spans are recreated under the exec-probe span since the SDK can't export spans with IDs that it didn't create
+// parents within the program's spans are kept by mapping the program's span IDs to the new ones
+func exportExecSpans(ctx context.Context, spans []otlpJSONSpan) {
+	var spansByID map[string]*otlpJSONSpan = map[string]*otlpJSONSpan{}
+	for i := range spans {
+		spansByID[spans[i].SpanID] = &spans[i]
+	}
+	var contexts map[string]context.Context = map[string]context.Context{}
+	var exporting map[string]bool = map[string]bool{}
+	var export func(span *otlpJSONSpan) context.Context
+	export = func(span *otlpJSONSpan) context.Context {
+		if spanContext, found := contexts[span.SpanID]; found {
+			return spanContext
+		}
+		parentContext := ctx
+		parent, found := spansByID[span.ParentSpanID]
+		// a span that claims to be its own ancestor is put directly under the probe's span
+		if found && !exporting[span.SpanID] {
+			exporting[span.SpanID] = true
+			parentContext = export(parent)
+			// the span may have been exported while following a loop of parents
+			if spanContext, found := contexts[span.SpanID]; found {
+				return spanContext
+			}
+		}
+		spanContext, newSpan := (*tracer).Start(parentContext, span.Name,
+			trace.WithTimestamp(time.Unix(0, int64(span.StartTimeUnixNano))),
+			trace.WithSpanKind(trace.SpanKind(span.Kind)),
+			trace.WithAttributes(otlpJSONAttributes(span.Attributes)...),
+		)
+		for _, event := range span.Events {
+			newSpan.AddEvent(event.Name,
+				trace.WithTimestamp(time.Unix(0, int64(event.TimeUnixNano))),
+				trace.WithAttributes(otlpJSONAttributes(event.Attributes)...),
+			)
+		}
+		// the status codes in OTLP are in a different order to the ones in the Go API
+		switch span.Status.Code {
+		case 1:
+			newSpan.SetStatus(codes.Ok, span.Status.Message)
+		case 2:
+			newSpan.SetStatus(codes.Error, span.Status.Message)
+		}
+		newSpan.End(trace.WithTimestamp(time.Unix(0, int64(span.EndTimeUnixNano))))
+		contexts[span.SpanID] = spanContext
+		return spanContext
+	}
+	for i := range spans {
+		export(&spans[i])
+	}
+	logger.Debug("exported spans from exec probe", "len(spans)", len(spans))
+}
@@ -0,0 +1,79 @@
+package egress
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// variables are set from the named capture groups of receive steps (for example "(?P<token>[a-z0-9]+)")
+// and can be used in later steps with Go's template syntax (for example "AUTH {{.token}}")
+type ExpectVariables map[string]string
+
+func newExpectVariables(span *trace.Span) ExpectVariables {
+	variables := ExpectVariables{}
+
+	// the W3C trace context for the probe's span, so that the app can continue the trace
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpan(context.Background(), *span), carrier)
+	variables["traceparent"] = carrier.Get("traceparent")
+	variables["tracestate"] = carrier.Get("tracestate")
+
+	// the nonce is the same for the whole conversation so that it can be sent and then checked when it's echoed back
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		logger.Error("could not generate nonce for expect variables", "err", err)
+	}
+	variables["nonce"] = hex.EncodeToString(nonceBytes)
+
+	return variables
+}
+
+// returns nil if the text doesn't use any variables, so that the text can be used as is
+func newExpectTemplate(text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New("expect").Option("missingkey=error").Parse(text)
+}
+
+func (variables ExpectVariables) fill(expectTemplate *template.Template, quoteForRegEx bool) (string, error) {
+	data := map[string]string{}
+	for name, value := range variables {
+		data[name] = value
+	}
+	// the time is set when the template is used rather than at the start of the conversation
+	now := time.Now()
+	data["timestamp"] = now.UTC().Format(time.RFC3339Nano)
+	data["unixTimestamp"] = fmt.Sprintf("%d", now.Unix())
+	if quoteForRegEx {
+		for name, value := range data {
+			data[name] = regexp.QuoteMeta(value)
+		}
+	}
+	var builder strings.Builder
+	err := expectTemplate.Execute(&builder, data)
+	if err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+func (variables ExpectVariables) capture(regex *regexp.Regexp, matches [][]byte) {
+	for i, name := range regex.SubexpNames() {
+		if name == "" || i >= len(matches) {
+			continue
+		}
+		variables[name] = string(matches[i])
+		logger.Debug("captured variable", "name", name, "value", variables[name])
+	}
+}
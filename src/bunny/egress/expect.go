@@ -3,72 +3,476 @@ package egress
 import (
 	"bufio"
 	"bunny/config"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type ExpectStep interface {
-	do(readWriter *bufio.ReadWriter, span *trace.Span) (bool, error)
+	do(conversation *ExpectConversation) (bool, error)
+}
+
+// the state shared between the steps of a single run of an expect script
+type ExpectConversation struct {
+	context    context.Context
+	connection net.Conn
+	host       string
+	deadline   time.Time
+	readWriter *bufio.ReadWriter
+	span       *trace.Span
+	variables  ExpectVariables
+}
+
+// wraps each step so that it gets its own span, timeout, and can be optional
+type ControlledStep struct {
+	name     string
+	step     ExpectStep
+	timeout  time.Duration
+	optional bool
 }
 
 type SendStep struct {
-	text      string
-	delimiter byte
+	text         string
+	template     *template.Template
+	encoding     string
+	delimiter    []byte
+	lengthPrefix *LengthPrefix
 }
 
 type ReceiveStep struct {
-	regex     *regexp.Regexp
-	delimiter byte
+	regex    *regexp.Regexp
+	template *template.Template
+	maxReads int
+	framing  *Framing
+}
+
+type OneOfStep struct {
+	branches []ExpectBranch
+	framing  *Framing
+}
+
+// upgrades the connection to TLS part way through the conversation (as is done by SMTP, IMAP, and PostgreSQL)
+type StartTLSStep struct {
+	tlsConfig *tls.Config
+}
+
+type ExpectBranch struct {
+	regex    *regexp.Regexp
+	template *template.Template
+	steps    []ExpectStep
+}
+
+// describes how to find the end of what's received
+type Framing struct {
+	encoding       string
+	delimiter      []byte
+	length         int
+	lengthPrefix   *LengthPrefix
+	readLimitBytes int
+}
+
+type LengthPrefix struct {
+	size           int
+	byteOrder      binary.ByteOrder
+	includesPrefix bool
+}
+
+const expectEncodingText string = "text"
+const expectEncodingHex string = "hex"
+const expectEncodingBase64 string = "base64"
+
+// an upper bound on how much a single receive step will read so that a misbehaving server can't use up all our memory
+// (unless the config says otherwise)
+const expectDefaultReadLimitBytes int = 1024 * 1024
+
+// how much of what's sent or received is added to each step's span
+const expectSpanTextLimit int = 256
+
+func newExpectSteps(expectConfigs []config.ExpectConfig) ([]ExpectStep, bool) {
+	var expectSteps []ExpectStep = []ExpectStep{}
+	for _, expectStepConfig := range expectConfigs {
+		var expectStep ExpectStep = newExpectStep(&expectStepConfig)
+		if expectStep == nil {
+			return nil, false
+		}
+		expectSteps = append(expectSteps, expectStep)
+	}
+	return expectSteps, true
 }
 
 func newExpectStep(expectStepConfig *config.ExpectConfig) ExpectStep {
-	if expectStepConfig.Send != nil && expectStepConfig.Receive != nil {
-		logger.Error("both send and receive set in single step of tcp socket action")
+	var stepCount int = 0
+	for _, isSet := range []bool{
+		expectStepConfig.Send != nil,
+		expectStepConfig.Receive != nil,
+		expectStepConfig.OneOf != nil,
+		expectStepConfig.StartTLS != nil,
+	} {
+		if isSet {
+			stepCount++
+		}
+	}
+	if stepCount != 1 {
+		logger.Error("exactly one of send, receive, oneOf, or starttls must be set in each step of an expect script")
 		return nil
 	}
+
+	var name string
+	var step ExpectStep
 	if expectStepConfig.Send != nil {
-		if len(expectStepConfig.Send.Delimiter) != 1 {
-			logger.Error("expect step delimiters must be a length one string")
+		name = "expect-send"
+		step = newSendStep(expectStepConfig.Send)
+	} else if expectStepConfig.Receive != nil {
+		name = "expect-receive"
+		step = newReceiveStep(expectStepConfig.Receive)
+	} else if expectStepConfig.OneOf != nil {
+		name = "expect-one-of"
+		step = newOneOfStep(expectStepConfig.OneOf)
+	} else {
+		name = "expect-starttls"
+		step = newStartTLSStep(expectStepConfig.StartTLS)
+	}
+	if step == nil {
+		return nil
+	}
+
+	var timeout time.Duration = 0
+	if expectStepConfig.TimeoutMilliseconds != nil {
+		timeout = time.Duration(*expectStepConfig.TimeoutMilliseconds) * time.Millisecond
+	}
+	return ControlledStep{
+		name:     name,
+		step:     step,
+		timeout:  timeout,
+		optional: expectStepConfig.Optional,
+	}
+}
+
+func newSendStep(sendStepConfig *config.SendStepConfig) ExpectStep {
+	encoding, ok := newExpectEncoding(sendStepConfig.Encoding)
+	if !ok {
+		return nil
+	}
+	sendTemplate, err := newExpectTemplate(sendStepConfig.Text)
+	if err != nil {
+		logger.Error("could not parse template for send step", "sendStepConfig.Text", sendStepConfig.Text, "err", err)
+		return nil
+	}
+	delimiter, err := decodeExpectText(sendStepConfig.Delimiter, encoding)
+	if err != nil {
+		logger.Error("could not decode delimiter for send step", "encoding", encoding, "err", err)
+		return nil
+	}
+	var lengthPrefix *LengthPrefix = nil
+	if sendStepConfig.LengthPrefix != nil {
+		lengthPrefix = newLengthPrefix(sendStepConfig.LengthPrefix)
+		if lengthPrefix == nil {
 			return nil
 		}
-		text := expectStepConfig.Send.Text
-		byteSlice := []byte(expectStepConfig.Send.Delimiter)
-		step := SendStep{
-			text:      text,
-			delimiter: byteSlice[0],
+	}
+	// if there's nothing to fill in, we can check the text now rather than when the step runs
+	if sendTemplate == nil {
+		_, err = decodeExpectText(sendStepConfig.Text, encoding)
+		if err != nil {
+			logger.Error("could not decode text for send step", "encoding", encoding, "err", err)
+			return nil
 		}
-		return step
-	} else {
-		if len(expectStepConfig.Receive.Delimiter) != 1 {
-			logger.Error("expect step delimiters must be a length one string")
+	}
+	step := SendStep{
+		text:         sendStepConfig.Text,
+		template:     sendTemplate,
+		encoding:     encoding,
+		delimiter:    delimiter,
+		lengthPrefix: lengthPrefix,
+	}
+	return step
+}
+
+func newReceiveStep(receiveStepConfig *config.ReceiveStepConfig) ExpectStep {
+	regex, receiveTemplate, ok := newExpectRegex(receiveStepConfig.RegEx)
+	if !ok {
+		return nil
+	}
+	framing := newFraming(&receiveStepConfig.FramingConfig)
+	if framing == nil {
+		return nil
+	}
+	var maxReads int = 1
+	if receiveStepConfig.MaxReads != nil {
+		maxReads = *receiveStepConfig.MaxReads
+		if maxReads <= 0 {
+			logger.Error("maxReads for receive step must be greater than zero", "maxReads", maxReads)
 			return nil
 		}
-		regexString := expectStepConfig.Receive.RegEx
-		regex, err := regexp.Compile(regexString)
-		if err != nil {
-			logger.Error("error in regex for tcp socket action",
-				"expectStep.Receive.RegEx", expectStepConfig.Receive.RegEx)
+	}
+	var receiveStep = ReceiveStep{
+		regex:    regex,
+		template: receiveTemplate,
+		maxReads: maxReads,
+		framing:  framing,
+	}
+	return &receiveStep
+}
+
+func newOneOfStep(oneOfStepConfig *config.OneOfStepConfig) ExpectStep {
+	if len(oneOfStepConfig.Branches) == 0 {
+		logger.Error("oneOf step must have at least one branch")
+		return nil
+	}
+	framing := newFraming(&oneOfStepConfig.FramingConfig)
+	if framing == nil {
+		return nil
+	}
+	var branches []ExpectBranch = []ExpectBranch{}
+	for _, branchConfig := range oneOfStepConfig.Branches {
+		regex, branchTemplate, ok := newExpectRegex(branchConfig.RegEx)
+		if !ok {
 			return nil
 		}
-		byteSlice := []byte(expectStepConfig.Receive.Delimiter)
-		var receiveStep = ReceiveStep{
-			regex:     regex,
-			delimiter: byteSlice[0],
+		steps, ok := newExpectSteps(branchConfig.Steps)
+		if !ok {
+			return nil
 		}
-		return &receiveStep
+		branches = append(branches, ExpectBranch{
+			regex:    regex,
+			template: branchTemplate,
+			steps:    steps,
+		})
+	}
+	return OneOfStep{
+		branches: branches,
+		framing:  framing,
 	}
 }
 
-func expect(tcpConnection *net.Conn, steps []ExpectStep, span *trace.Span) bool {
-	reader := bufio.NewReader(*tcpConnection)
-	writer := bufio.NewWriter(*tcpConnection)
-	readWriter := bufio.NewReadWriter(reader, writer)
+func newStartTLSStep(tlsConfig *config.TLSConfig) ExpectStep {
+	newTLSConfig := newTLSConfig(tlsConfig)
+	if newTLSConfig == nil {
+		return nil
+	}
+	return StartTLSStep{
+		tlsConfig: newTLSConfig,
+	}
+}
+
+// a regex which uses variables can only be compiled once the variables are known (when the step runs)
+// so either the regex or the template is returned
+func newExpectRegex(regexString string) (*regexp.Regexp, *template.Template, bool) {
+	regexTemplate, err := newExpectTemplate(regexString)
+	if err != nil {
+		logger.Error("could not parse template for regex in expect step", "regexString", regexString, "err", err)
+		return nil, nil, false
+	}
+	if regexTemplate != nil {
+		return nil, regexTemplate, true
+	}
+	regex, err := regexp.Compile(regexString)
+	if err != nil {
+		logger.Error("error in regex for expect step", "regexString", regexString, "err", err)
+		return nil, nil, false
+	}
+	return regex, nil, true
+}
+
+func newFraming(framingConfig *config.FramingConfig) *Framing {
+	encoding, ok := newExpectEncoding(framingConfig.Encoding)
+	if !ok {
+		return nil
+	}
+	delimiter, err := decodeExpectText(framingConfig.Delimiter, encoding)
+	if err != nil {
+		logger.Error("could not decode delimiter for expect step", "encoding", encoding, "err", err)
+		return nil
+	}
+
+	// exactly one of the ways of framing what's received must be set
+	var framingCount int = 0
+	if len(delimiter) > 0 {
+		framingCount++
+	}
+	var length int = 0
+	if framingConfig.Length != nil {
+		framingCount++
+		length = *framingConfig.Length
+		if length <= 0 {
+			logger.Error("length for expect step must be greater than zero", "length", length)
+			return nil
+		}
+	}
+	var lengthPrefix *LengthPrefix = nil
+	if framingConfig.LengthPrefix != nil {
+		framingCount++
+		lengthPrefix = newLengthPrefix(framingConfig.LengthPrefix)
+		if lengthPrefix == nil {
+			return nil
+		}
+	}
+	if framingCount != 1 {
+		logger.Error("expect step must set exactly one of delimiter, length, or lengthPrefix")
+		return nil
+	}
+
+	var readLimitBytes int = expectDefaultReadLimitBytes
+	if framingConfig.ReadLimitBytes != nil {
+		readLimitBytes = *framingConfig.ReadLimitBytes
+		if readLimitBytes <= 0 {
+			logger.Error("readLimitBytes for expect step must be greater than zero", "readLimitBytes", readLimitBytes)
+			return nil
+		}
+	}
+
+	return &Framing{
+		encoding:       encoding,
+		delimiter:      delimiter,
+		length:         length,
+		lengthPrefix:   lengthPrefix,
+		readLimitBytes: readLimitBytes,
+	}
+}
+
+func newExpectEncoding(encoding *string) (string, bool) {
+	if encoding == nil || *encoding == "" {
+		return expectEncodingText, true
+	}
+	switch strings.ToLower(*encoding) {
+	case expectEncodingText:
+		return expectEncodingText, true
+	case expectEncodingHex:
+		return expectEncodingHex, true
+	case expectEncodingBase64:
+		return expectEncodingBase64, true
+	}
+	logger.Error("unknown encoding for expect step. Must be one of text, hex, or base64", "encoding", *encoding)
+	return "", false
+}
+
+func decodeExpectText(text string, encoding string) ([]byte, error) {
+	switch encoding {
+	case expectEncodingHex:
+		// allow for whitespace between bytes to make long payloads readable
+		return hex.DecodeString(strings.Join(strings.Fields(text), ""))
+	case expectEncodingBase64:
+		return base64.StdEncoding.DecodeString(text)
+	default:
+		return []byte(text), nil
+	}
+}
+
+func encodeExpectBytes(data []byte, encoding string) []byte {
+	switch encoding {
+	case expectEncodingHex:
+		return []byte(hex.EncodeToString(data))
+	case expectEncodingBase64:
+		return []byte(base64.StdEncoding.EncodeToString(data))
+	default:
+		return data
+	}
+}
+
+func newLengthPrefix(lengthPrefixConfig *config.LengthPrefixConfig) *LengthPrefix {
+	switch lengthPrefixConfig.Size {
+	case 1, 2, 4, 8:
+	default:
+		logger.Error("lengthPrefix size must be one of 1, 2, 4, or 8", "size", lengthPrefixConfig.Size)
+		return nil
+	}
+	var byteOrder binary.ByteOrder = binary.BigEndian
+	switch strings.ToLower(lengthPrefixConfig.Endian) {
+	case "", "big":
+		byteOrder = binary.BigEndian
+	case "little":
+		byteOrder = binary.LittleEndian
+	default:
+		logger.Error("lengthPrefix endian must be either big or little", "endian", lengthPrefixConfig.Endian)
+		return nil
+	}
+	return &LengthPrefix{
+		size:           lengthPrefixConfig.Size,
+		byteOrder:      byteOrder,
+		includesPrefix: lengthPrefixConfig.IncludesPrefix,
+	}
+}
+
+func (lengthPrefix LengthPrefix) encode(payloadLength int) ([]byte, error) {
+	length := uint64(payloadLength)
+	if lengthPrefix.includesPrefix {
+		length += uint64(lengthPrefix.size)
+	}
+	// a length that doesn't fit would be truncated and the other end would read the wrong number of bytes
+	if lengthPrefix.size < 8 && length >= 1<<(8*lengthPrefix.size) {
+		return nil, fmt.Errorf("length %v does not fit in a %v byte length prefix", length, lengthPrefix.size)
+	}
+	prefix := make([]byte, 8)
+	switch lengthPrefix.size {
+	case 1:
+		prefix[0] = byte(length)
+	case 2:
+		lengthPrefix.byteOrder.PutUint16(prefix, uint16(length))
+	case 4:
+		lengthPrefix.byteOrder.PutUint32(prefix, uint32(length))
+	case 8:
+		lengthPrefix.byteOrder.PutUint64(prefix, length)
+	}
+	return prefix[:lengthPrefix.size], nil
+}
+
+func (lengthPrefix LengthPrefix) decode(prefix []byte, readLimitBytes int) (int, error) {
+	var length uint64 = 0
+	switch lengthPrefix.size {
+	case 1:
+		length = uint64(prefix[0])
+	case 2:
+		length = uint64(lengthPrefix.byteOrder.Uint16(prefix))
+	case 4:
+		length = uint64(lengthPrefix.byteOrder.Uint32(prefix))
+	case 8:
+		length = lengthPrefix.byteOrder.Uint64(prefix)
+	}
+	if lengthPrefix.includesPrefix {
+		if length < uint64(lengthPrefix.size) {
+			return 0, errors.New("length prefix is smaller than the prefix itself")
+		}
+		length -= uint64(lengthPrefix.size)
+	}
+	if length > uint64(readLimitBytes) {
+		return 0, errors.New("length prefix is larger than the read limit")
+	}
+	return int(length), nil
+}
+
+// host is used to check the server's certificate if the connection is upgraded to TLS
+// deadline is when the whole conversation must be complete by
+func expect(ctx context.Context, connection net.Conn, host string, deadline time.Time, steps []ExpectStep, span *trace.Span) bool {
+	conversation := ExpectConversation{
+		context:    ctx,
+		connection: connection,
+		host:       host,
+		deadline:   deadline,
+		readWriter: bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection)),
+		span:       span,
+		variables:  newExpectVariables(span),
+	}
+	return conversation.run(steps)
+}
+
+func (conversation *ExpectConversation) run(steps []ExpectStep) bool {
 	for _, step := range steps {
-		successful, err := step.do(readWriter, span)
+		successful, err := step.do(conversation)
 		if err != nil || !successful {
 			return false
 		}
@@ -76,39 +480,254 @@ func expect(tcpConnection *net.Conn, steps []ExpectStep, span *trace.Span) bool
 	return true
 }
 
-func (step SendStep) do(readWriter *bufio.ReadWriter, span *trace.Span) (bool, error) {
+func (step ControlledStep) do(conversation *ExpectConversation) (bool, error) {
+	// each step gets its own span, which is used by the step in place of the span for the whole conversation
+	parentContext := conversation.context
+	parentSpan := conversation.span
+	stepContext, stepSpan := (*tracer).Start(parentContext, step.name)
+	defer stepSpan.End()
+	conversation.context = stepContext
+	conversation.span = &stepSpan
+	defer func() {
+		conversation.context = parentContext
+		conversation.span = parentSpan
+	}()
+
+	// a step can have less time than the whole conversation but not more
+	if step.timeout > 0 {
+		stepDeadline := time.Now().Add(step.timeout)
+		if stepDeadline.After(conversation.deadline) {
+			stepDeadline = conversation.deadline
+		}
+		conversation.connection.SetDeadline(stepDeadline)
+		defer conversation.connection.SetDeadline(conversation.deadline)
+	}
+
+	successful, err := step.step.do(conversation)
+	if err != nil || !successful {
+		message := "expect step failed"
+		if err != nil {
+			stepSpan.RecordError(err)
+		}
+		if step.optional {
+			// what was read by the failed step is lost, but the conversation continues
+			message = "optional expect step failed - continuing"
+			logger.Debug(message, "err", err)
+			stepSpan.SetStatus(codes.Unset, message)
+			return true, nil
+		}
+		stepSpan.SetStatus(codes.Error, message)
+		return successful, err
+	}
+	stepSpan.SetStatus(codes.Ok, "expect step succeeded")
+	return true, nil
+}
+
+func (step SendStep) do(conversation *ExpectConversation) (bool, error) {
 	logger.Debug("send step begins", "step.text", step.text)
-	(*span).AddEvent(step.text)
-	writer := readWriter.Writer
-	fullText := step.text + string(step.delimiter)
-	for i := 0; i < len(fullText); {
-		remainingText := fullText[i:]
-		bytesWritten, err := fmt.Fprint(writer, remainingText)
+	text := step.text
+	if step.template != nil {
+		var err error
+		text, err = conversation.variables.fill(step.template, false)
+		if err != nil {
+			logger.Debug("send step fails - could not fill in template", "err", err)
+			return false, err
+		}
+	}
+	(*conversation.span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan([]byte(text))))
+	payload, err := decodeExpectText(text, step.encoding)
+	if err != nil {
+		logger.Debug("send step fails - could not decode text", "err", err)
+		return false, err
+	}
+	payload = append(payload, step.delimiter...)
+	writer := conversation.readWriter.Writer
+	fullPayload := payload
+	if step.lengthPrefix != nil {
+		prefix, err := step.lengthPrefix.encode(len(payload))
+		if err != nil {
+			logger.Debug("send step fails - payload is too long for the length prefix", "err", err)
+			return false, err
+		}
+		fullPayload = append(prefix, payload...)
+	}
+	for i := 0; i < len(fullPayload); {
+		bytesWritten, err := writer.Write(fullPayload[i:])
 		if bytesWritten == 0 {
 			logger.Debug("send step fails - no bytes written")
 			return false, err
 		}
 		i += bytesWritten
 	}
-	err := writer.Flush()
+	err = writer.Flush()
 	if err != nil {
 		logger.Debug("send step fails - error during flush", "err", err)
 		return false, err
 	}
+	(*conversation.span).SetAttributes(attribute.Int("bunny.expect.bytes", len(fullPayload)))
 	logger.Debug("send step succeeds")
 	return true, nil
 }
 
-func (step ReceiveStep) do(readWriter *bufio.ReadWriter, span *trace.Span) (bool, error) {
-	logger.Debug("receive step begins", "step.regex.String()", step.regex.String())
-	(*span).AddEvent(step.regex.String())
-	wordsSent, err := readWriter.Reader.ReadString(step.delimiter)
+func (step ReceiveStep) do(conversation *ExpectConversation) (bool, error) {
+	regex, err := conversation.regex(step.regex, step.template)
 	if err != nil {
-		logger.Debug("receive step fails", "err", err)
+		logger.Debug("receive step fails - could not build regex", "err", err)
 		return false, err
 	}
-	trimmedWords := strings.TrimSuffix(wordsSent, string(step.delimiter))
-	result := step.regex.MatchString(trimmedWords)
-	logger.Debug("receive step result", "result", result)
-	return result, nil
+	logger.Debug("receive step begins", "regex.String()", regex.String())
+	(*conversation.span).SetAttributes(attribute.String("bunny.expect.regex", regex.String()))
+
+	// when maxReads is more than one, we keep reading until something matches
+	// (useful for skipping over banners or multi-line responses)
+	var totalBytes int = 0
+	for i := 0; i < step.maxReads; i++ {
+		received, err := step.framing.read(conversation.readWriter.Reader)
+		totalBytes += len(received)
+		(*conversation.span).SetAttributes(
+			attribute.Int("bunny.expect.bytes", totalBytes),
+			attribute.Int("bunny.expect.reads", i+1),
+		)
+		if err != nil {
+			logger.Debug("receive step fails", "err", err)
+			return false, err
+		}
+		// the regex is checked against the bytes as they were received (unless an encoding was set)
+		// which lets binary protocols be matched with escapes like \x00
+		encodedReceived := encodeExpectBytes(received, step.framing.encoding)
+		(*conversation.span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan(encodedReceived)))
+		matches := regex.FindSubmatch(encodedReceived)
+		if matches != nil {
+			conversation.variables.capture(regex, matches)
+			(*conversation.span).SetAttributes(attribute.String("bunny.expect.matched", truncateForSpan(matches[0])))
+			logger.Debug("receive step result", "result", true)
+			return true, nil
+		}
+	}
+	logger.Debug("receive step result", "result", false)
+	return false, nil
+}
+
+func (step OneOfStep) do(conversation *ExpectConversation) (bool, error) {
+	logger.Debug("one of step begins")
+	received, err := step.framing.read(conversation.readWriter.Reader)
+	(*conversation.span).SetAttributes(attribute.Int("bunny.expect.bytes", len(received)))
+	if err != nil {
+		logger.Debug("one of step fails", "err", err)
+		return false, err
+	}
+	encodedReceived := encodeExpectBytes(received, step.framing.encoding)
+	(*conversation.span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan(encodedReceived)))
+
+	// the first branch whose regex matches is the one whose steps are run
+	for i, branch := range step.branches {
+		regex, err := conversation.regex(branch.regex, branch.template)
+		if err != nil {
+			logger.Debug("one of step fails - could not build regex", "err", err)
+			return false, err
+		}
+		matches := regex.FindSubmatch(encodedReceived)
+		if matches == nil {
+			continue
+		}
+		logger.Debug("one of step selected branch", "branch", i, "regex", regex.String())
+		conversation.variables.capture(regex, matches)
+		(*conversation.span).SetAttributes(
+			attribute.Int("bunny.expect.branch", i),
+			attribute.String("bunny.expect.matched", truncateForSpan(matches[0])),
+		)
+		return conversation.run(branch.steps), nil
+	}
+	logger.Debug("one of step fails - no branch matched")
+	return false, nil
+}
+
+func (step StartTLSStep) do(conversation *ExpectConversation) (bool, error) {
+	logger.Debug("starttls step begins")
+	// anything already buffered was sent before the upgrade and so would be lost (or worse, treated as part of the handshake)
+	if conversation.readWriter.Reader.Buffered() > 0 {
+		logger.Debug("starttls step fails - unread data received before tls handshake")
+		return false, errors.New("unread data received before tls handshake")
+	}
+	tlsConnection := tls.Client(conversation.connection, tlsConfigForHost(step.tlsConfig, conversation.host))
+	err := tlsConnection.HandshakeContext(conversation.context)
+	if err != nil {
+		logger.Debug("starttls step fails - tls handshake failed", "err", err)
+		return false, err
+	}
+	addTLSSpanAttributes(conversation.span, tlsConnection.ConnectionState())
+	// the rest of the conversation happens over the tls connection
+	conversation.connection = tlsConnection
+	conversation.readWriter = bufio.NewReadWriter(bufio.NewReader(tlsConnection), bufio.NewWriter(tlsConnection))
+	logger.Debug("starttls step succeeds")
+	return true, nil
+}
+
+func (conversation *ExpectConversation) regex(regex *regexp.Regexp, regexTemplate *template.Template) (*regexp.Regexp, error) {
+	if regexTemplate == nil {
+		return regex, nil
+	}
+	// values are quoted so that they're matched literally rather than as part of the regex
+	regexString, err := conversation.variables.fill(regexTemplate, true)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(regexString)
+}
+
+// returns what was received without any delimiter or length prefix
+func (framing Framing) read(reader *bufio.Reader) ([]byte, error) {
+	if framing.length > 0 {
+		if framing.length > framing.readLimitBytes {
+			return nil, errors.New("length is larger than the read limit")
+		}
+		return readFull(reader, framing.length)
+	}
+	if framing.lengthPrefix != nil {
+		prefix, err := readFull(reader, framing.lengthPrefix.size)
+		if err != nil {
+			return nil, err
+		}
+		length, err := framing.lengthPrefix.decode(prefix, framing.readLimitBytes)
+		if err != nil {
+			return nil, err
+		}
+		return readFull(reader, length)
+	}
+	// read until the last byte of the delimiter is seen and then check if the whole delimiter was received
+	lastDelimiterByte := framing.delimiter[len(framing.delimiter)-1]
+	var received []byte = []byte{}
+	for {
+		// unlike ReadBytes, ReadSlice returns when its buffer is full, which lets us enforce the read limit
+		chunk, err := reader.ReadSlice(lastDelimiterByte)
+		received = append(received, chunk...)
+		if len(received) > framing.readLimitBytes {
+			return received, errors.New("delimiter not found before the read limit")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return received, err
+		}
+		if bytes.HasSuffix(received, framing.delimiter) {
+			return bytes.TrimSuffix(received, framing.delimiter), nil
+		}
+	}
+}
+
+func readFull(reader *bufio.Reader, length int) ([]byte, error) {
+	received := make([]byte, length)
+	bytesRead, err := io.ReadFull(reader, received)
+	if err != nil {
+		return received[:bytesRead], err
+	}
+	return received, nil
+}
+
+func truncateForSpan(data []byte) string {
+	if len(data) <= expectSpanTextLimit {
+		return string(data)
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", data[:expectSpanTextLimit], len(data)-expectSpanTextLimit)
 }
@@ -0,0 +1,41 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLengthPrefixEncode(t *testing.T) {
+	tests := []struct {
+		name           string
+		size           int
+		includesPrefix bool
+		payloadLength  int
+		prefix         []byte
+	}{
+		{name: "1 byte", size: 1, payloadLength: 255, prefix: []byte{255}},
+		{name: "1 byte too long", size: 1, payloadLength: 256},
+		{name: "1 byte including prefix too long", size: 1, includesPrefix: true, payloadLength: 255},
+		{name: "2 bytes", size: 2, payloadLength: 65535, prefix: []byte{0xff, 0xff}},
+		{name: "2 bytes too long", size: 2, payloadLength: 65536},
+		{name: "2 bytes including prefix", size: 2, includesPrefix: true, payloadLength: 3, prefix: []byte{0, 5}},
+		{name: "4 bytes", size: 4, payloadLength: 65536, prefix: []byte{0, 1, 0, 0}},
+		{name: "8 bytes", size: 8, payloadLength: 1, prefix: []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lengthPrefix := LengthPrefix{size: test.size, byteOrder: binary.BigEndian, includesPrefix: test.includesPrefix}
+			prefix, err := lengthPrefix.encode(test.payloadLength)
+			if test.prefix == nil {
+				if err == nil {
+					t.Errorf("expected an error but got prefix %v", prefix)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(prefix, test.prefix) {
+				t.Errorf("expected prefix %v but got %v (err %v)", test.prefix, prefix, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package egress
+
+import (
+	"bunny/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectiongrpc "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type GRPCMethod struct {
+	serviceName        string
+	methodName         string
+	request            string
+	statusCode         codes.Code
+	jsonPathAssertions []JSONPathAssertion
+	descriptor         *grpcMethodDescriptor
+}
+
+// the descriptor for the method is looked up once (either from the descriptor set file or via server reflection)
+// and then shared between every run of the probe
+type grpcMethodDescriptor struct {
+	mutex            sync.Mutex
+	methodDescriptor protoreflect.MethodDescriptor
+}
+
+func newGRPCMethod(grpcMethodConfig *config.GRPCMethodConfig) *GRPCMethod {
+	if grpcMethodConfig == nil {
+		return nil
+	}
+
+	// we accept both "package.Service/Method" and "/package.Service/Method"
+	name := strings.TrimPrefix(grpcMethodConfig.Name, "/")
+	serviceName, methodName, found := strings.Cut(name, "/")
+	if !found || serviceName == "" || methodName == "" {
+		logger.Error("grpc method name must be of the form service/method", "grpcMethodConfig.Name", grpcMethodConfig.Name)
+		return nil
+	}
+
+	var statusCode codes.Code = codes.OK
+	if grpcMethodConfig.StatusCode != nil {
+		// status codes can be given either as a number or by name (like "NOT_FOUND")
+		var err error = nil
+		number, numberErr := strconv.Atoi(*grpcMethodConfig.StatusCode)
+		if numberErr == nil {
+			statusCode = codes.Code(number)
+		} else {
+			err = statusCode.UnmarshalJSON([]byte(fmt.Sprintf("%q", strings.ToUpper(*grpcMethodConfig.StatusCode))))
+		}
+		if err != nil {
+			logger.Error("unknown status code for grpc method", "grpcMethodConfig.StatusCode", *grpcMethodConfig.StatusCode, "err", err)
+			return nil
+		}
+	}
+
+	jsonPathAssertions, ok := newJSONPathAssertions(grpcMethodConfig.JSONPath)
+	if !ok {
+		return nil
+	}
+
+	request := grpcMethodConfig.Request
+	if strings.TrimSpace(request) == "" {
+		request = "{}"
+	}
+
+	descriptor := &grpcMethodDescriptor{}
+	if grpcMethodConfig.DescriptorSetFile != nil && *grpcMethodConfig.DescriptorSetFile != "" {
+		methodDescriptor, err := loadMethodDescriptorFromFile(*grpcMethodConfig.DescriptorSetFile, serviceName, methodName)
+		if err != nil {
+			logger.Error("could not load grpc method from descriptor set file",
+				"grpcMethodConfig.DescriptorSetFile", *grpcMethodConfig.DescriptorSetFile,
+				"err", err)
+			return nil
+		}
+		descriptor.methodDescriptor = methodDescriptor
+	}
+
+	return &GRPCMethod{
+		serviceName:        serviceName,
+		methodName:         methodName,
+		request:            request,
+		statusCode:         statusCode,
+		jsonPathAssertions: jsonPathAssertions,
+		descriptor:         descriptor,
+	}
+}
+
+// returns an empty message if the method call was successful and a message explaining why if it wasn't
+func (method GRPCMethod) invoke(ctx context.Context, conn *grpc.ClientConn, span *trace.Span) string {
+	methodDescriptor, err := method.resolve(ctx, conn)
+	if err != nil {
+		logger.Debug("could not resolve grpc method", "err", err)
+		return "probe failed - could not resolve grpc method"
+	}
+
+	// build the request from the JSON in the config
+	request := dynamicpb.NewMessage(methodDescriptor.Input())
+	err = protojson.Unmarshal([]byte(method.request), request)
+	if err != nil {
+		logger.Debug("could not convert request json into grpc message", "err", err)
+		return "probe failed - could not build request for grpc method"
+	}
+	response := dynamicpb.NewMessage(methodDescriptor.Output())
+
+	fullMethodName := fmt.Sprintf("/%v/%v", method.serviceName, method.methodName)
+	err = conn.Invoke(ctx, fullMethodName, request, response, grpc.WaitForReady(false))
+	responseStatus := status.Convert(err)
+	(*span).SetAttributes(
+		attribute.String("rpc.method", fullMethodName),
+		attribute.Int("rpc.grpc.status_code", int(responseStatus.Code())),
+	)
+	if responseStatus.Code() != method.statusCode {
+		logger.Debug("unexpected status code from grpc method",
+			"expected", method.statusCode.String(),
+			"received", responseStatus.Code().String(),
+			"message", responseStatus.Message())
+		return fmt.Sprintf("probe failed - unexpected status code: %v", responseStatus.Code().String())
+	}
+
+	// there's no response body to check when an error status was expected
+	if err != nil || len(method.jsonPathAssertions) == 0 {
+		return ""
+	}
+	responseJSON, err := protojson.Marshal(response)
+	if err != nil {
+		logger.Debug("could not convert grpc response into json", "err", err)
+		return "probe failed - could not convert response to json"
+	}
+	var data interface{}
+	err = json.Unmarshal(responseJSON, &data)
+	if err != nil {
+		logger.Debug("could not parse json converted from grpc response", "err", err)
+		return "probe failed - could not convert response to json"
+	}
+	if !checkJSONPathAssertions(method.jsonPathAssertions, data) {
+		logger.Debug("jsonPath assertions failed", "response", string(responseJSON))
+		return "probe failed - jsonPath assertions failed"
+	}
+	return ""
+}
+
+func (method GRPCMethod) resolve(ctx context.Context, conn *grpc.ClientConn) (protoreflect.MethodDescriptor, error) {
+	method.descriptor.mutex.Lock()
+	defer method.descriptor.mutex.Unlock()
+	if method.descriptor.methodDescriptor != nil {
+		return method.descriptor.methodDescriptor, nil
+	}
+	logger.Debug("resolving grpc method via server reflection", "service", method.serviceName, "method", method.methodName)
+	methodDescriptor, err := loadMethodDescriptorViaReflection(ctx, conn, method.serviceName, method.methodName)
+	if err != nil {
+		return nil, err
+	}
+	method.descriptor.methodDescriptor = methodDescriptor
+	return methodDescriptor, nil
+}
+
+// the file should be a FileDescriptorSet, as created by "protoc --include_imports --descriptor_set_out=..."
+func loadMethodDescriptorFromFile(path string, serviceName string, methodName string) (protoreflect.MethodDescriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fileDescriptorSet descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(data, &fileDescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(&fileDescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	return findMethodDescriptor(files, serviceName, methodName)
+}
+
+func loadMethodDescriptorViaReflection(ctx context.Context, conn *grpc.ClientConn, serviceName string, methodName string) (protoreflect.MethodDescriptor, error) {
+	client := reflectiongrpc.NewServerReflectionClient(conn)
+	stream, err := client.ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	// ask for the file that defines the service and then for any of its dependencies that we haven't seen yet
+	var fileDescriptorProtos []*descriptorpb.FileDescriptorProto = []*descriptorpb.FileDescriptorProto{}
+	var seenFiles map[string]bool = map[string]bool{}
+	var requests []*reflectiongrpc.ServerReflectionRequest = []*reflectiongrpc.ServerReflectionRequest{
+		{MessageRequest: &reflectiongrpc.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: serviceName}},
+	}
+	for len(requests) > 0 {
+		request := requests[0]
+		requests = requests[1:]
+		err = stream.Send(request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if errorResponse := response.GetErrorResponse(); errorResponse != nil {
+			return nil, fmt.Errorf("reflection error %v: %v", errorResponse.GetErrorCode(), errorResponse.GetErrorMessage())
+		}
+		for _, fileDescriptorProtoBytes := range response.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fileDescriptorProto := &descriptorpb.FileDescriptorProto{}
+			err = proto.Unmarshal(fileDescriptorProtoBytes, fileDescriptorProto)
+			if err != nil {
+				return nil, err
+			}
+			if seenFiles[fileDescriptorProto.GetName()] {
+				continue
+			}
+			seenFiles[fileDescriptorProto.GetName()] = true
+			fileDescriptorProtos = append(fileDescriptorProtos, fileDescriptorProto)
+			for _, dependency := range fileDescriptorProto.GetDependency() {
+				if !seenFiles[dependency] {
+					// mark it now so that we only ask for each file once
+					seenFiles[dependency] = true
+					requests = append(requests, &reflectiongrpc.ServerReflectionRequest{
+						MessageRequest: &reflectiongrpc.ServerReflectionRequest_FileByFilename{FileByFilename: dependency},
+					})
+				}
+			}
+		}
+	}
+
+	files, err := protodesc.NewFiles(&descriptorpb.FileDescriptorSet{File: fileDescriptorProtos})
+	if err != nil {
+		return nil, err
+	}
+	return findMethodDescriptor(files, serviceName, methodName)
+}
+
+func findMethodDescriptor(files *protoregistry.Files, serviceName string, methodName string) (protoreflect.MethodDescriptor, error) {
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, err
+	}
+	serviceDescriptor, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, errors.New(serviceName + " is not a service")
+	}
+	methodDescriptor := serviceDescriptor.Methods().ByName(protoreflect.Name(methodName))
+	if methodDescriptor == nil {
+		return nil, errors.New("no method " + methodName + " in service " + serviceName)
+	}
+	if methodDescriptor.IsStreamingClient() || methodDescriptor.IsStreamingServer() {
+		return nil, errors.New("only unary methods are supported")
+	}
+	return methodDescriptor, nil
+}
@@ -0,0 +1,94 @@
+package egress
+
+import (
+	"bunny/config"
+	"bytes"
+	"regexp"
+	"strings"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+type JSONPathAssertion struct {
+	path  string
+	regex *regexp.Regexp
+}
+
+func newJSONPathAssertion(jsonPathConfig *config.JSONPathConfig) *JSONPathAssertion {
+	path, err := newJSONPath(jsonPathConfig.Path)
+	if err != nil {
+		logger.Error("error in jsonPath", "jsonPathConfig.Path", jsonPathConfig.Path, "err", err)
+		return nil
+	}
+	regex, err := regexp.Compile(jsonPathConfig.RegEx)
+	if err != nil {
+		logger.Error("error in regex for jsonPath", "jsonPathConfig.RegEx", jsonPathConfig.RegEx, "err", err)
+		return nil
+	}
+	return &JSONPathAssertion{
+		path:  path,
+		regex: regex,
+	}
+}
+
+func newJSONPathAssertions(jsonPathConfigs []config.JSONPathConfig) ([]JSONPathAssertion, bool) {
+	var assertions []JSONPathAssertion = []JSONPathAssertion{}
+	for _, jsonPathConfig := range jsonPathConfigs {
+		assertion := newJSONPathAssertion(&jsonPathConfig)
+		if assertion == nil {
+			return nil, false
+		}
+		assertions = append(assertions, *assertion)
+	}
+	return assertions, true
+}
+
+// we use the same JSONPath syntax as kubectl, which wants the expression wrapped in braces
+// since most people will write "$.foo.bar" or ".foo.bar", we add the braces if they're missing
+func newJSONPath(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+	// parse now so that we catch mistakes when the config is loaded rather than when the probe runs
+	err := jsonpath.New("bunny").Parse(path)
+	return path, err
+}
+
+// data is expected to be the result of json.Unmarshal into an interface{}
+func evaluateJSONPath(path string, data interface{}) (string, error) {
+	// a JSONPath keeps state while executing, so we parse a new one each time
+	// rather than sharing one between probes that may be running at the same time
+	j := jsonpath.New("bunny")
+	err := j.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	err = j.Execute(&buffer, data)
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// data is expected to be the result of json.Unmarshal into an interface{}
+func (assertion JSONPathAssertion) check(data interface{}) bool {
+	value, err := evaluateJSONPath(assertion.path, data)
+	if err != nil {
+		logger.Debug("jsonPath assertion fails - could not execute path", "path", assertion.path, "err", err)
+		return false
+	}
+	result := assertion.regex.MatchString(value)
+	logger.Debug("jsonPath assertion result", "path", assertion.path, "value", value, "result", result)
+	return result
+}
+
+func checkJSONPathAssertions(assertions []JSONPathAssertion, data interface{}) bool {
+	for _, assertion := range assertions {
+		if !assertion.check(data) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type CgroupAction struct {
+	path                string
+	maxMemoryUsageRatio *float64
+	maxPressure         []CgroupPressureThreshold
+	timeout             time.Duration
+}
+
+// fails the probe when a pressure average (like the avg10 of "some" in memory.pressure) is over percent
+type CgroupPressureThreshold struct {
+	resource string
+	kind     string
+	window   string
+	percent  float64
+}
+
+// the resources with pressure stall information
+// see: https://docs.kernel.org/accounting/psi.html
+var cgroupPressureResources []string = []string{"cpu", "memory", "io"}
+
+// the averages in the pressure files and the window label that they're recorded with
+var cgroupPressureWindows map[string]string = map[string]string{
+	"avg10":  "10s",
+	"avg60":  "60s",
+	"avg300": "300s",
+}
+
+func newCgroupAction(cgroupActionConfig *config.CgroupActionConfig, timeout time.Duration) *CgroupAction {
+	logger.Info("processing cgroup probe config")
+	if cgroupActionConfig == nil {
+		return nil
+	}
+
+	// Bunny's own cgroup is only the sidecar's container, so the cgroup to read (like the pod's) has to be given
+	if cgroupActionConfig.Path == nil || *cgroupActionConfig.Path == "" {
+		logger.Error("path must be set for cgroup action")
+		return nil
+	}
+	path := *cgroupActionConfig.Path
+	// every cgroup v2 directory has cgroup.controllers, so this catches a path that isn't mounted (or isn't a cgroup)
+	_, err := os.Stat(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		logger.Error("path for cgroup action is not a cgroup v2 directory", "path", path, "err", err)
+		return nil
+	}
+
+	var maxPressure []CgroupPressureThreshold = []CgroupPressureThreshold{}
+	for _, pressureConfig := range cgroupActionConfig.MaxPressure {
+		threshold := CgroupPressureThreshold{
+			resource: pressureConfig.Resource,
+			kind:     "some",
+			window:   "avg10",
+			percent:  pressureConfig.Percent,
+		}
+		if pressureConfig.Kind != nil {
+			threshold.kind = *pressureConfig.Kind
+		}
+		if pressureConfig.Window != nil {
+			threshold.window = *pressureConfig.Window
+		}
+		if !isCgroupPressureResource(threshold.resource) {
+			logger.Error("unknown resource in maxPressure for cgroup action", "resource", threshold.resource)
+			return nil
+		}
+		if threshold.kind != "some" && threshold.kind != "full" {
+			logger.Error("kind in maxPressure for cgroup action is neither some nor full", "kind", threshold.kind)
+			return nil
+		}
+		if _, ok := cgroupPressureWindows[threshold.window]; !ok {
+			logger.Error("unknown window in maxPressure for cgroup action", "window", threshold.window)
+			return nil
+		}
+		maxPressure = append(maxPressure, threshold)
+	}
+
+	return &CgroupAction{
+		path:                path,
+		maxMemoryUsageRatio: cgroupActionConfig.MaxMemoryUsageRatio,
+		maxPressure:         maxPressure,
+		timeout:             timeout,
+	}
+}
+
+func isCgroupPressureResource(resource string) bool {
+	for _, pressureResource := range cgroupPressureResources {
+		if resource == pressureResource {
+			return true
+		}
+	}
+	return false
+}
+
+func (action CgroupAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing cgroup probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	_, span := (*tracer).Start(timeoutContext, "cgroup-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("bunny.cgroup.path", action.path))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.check(probeName, &span)
+	if message == "" && time.Now().After(timeoutTime) {
+		message = "probe failed - timed out"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// reads the cgroup's files, records them in the local TSDB,
+// and then returns an empty message if the cgroup passes all of the checks and a message explaining why if it doesn't
+func (action CgroupAction) check(probeName string, span *trace.Span) string {
+	now := time.Now()
+	if _, err := os.Stat(filepath.Join(action.path, "cgroup.controllers")); err != nil {
+		logger.Debug("not a cgroup v2 directory", "path", action.path, "err", err)
+		return "probe failed - not a cgroup v2 directory"
+	}
+	var samples []telemetry.Sample = []telemetry.Sample{}
+
+	// not every kernel has pressure stall information turned on, and the root cgroup has no memory.max,
+	// so missing files are skipped rather than failing the probe (unless they're needed for a check)
+	var pressures map[string]map[string]map[string]float64 = map[string]map[string]map[string]float64{}
+	for _, resource := range cgroupPressureResources {
+		pressure, err := readCgroupPressure(filepath.Join(action.path, resource+".pressure"))
+		if err != nil {
+			logger.Debug("could not read pressure", "resource", resource, "err", err)
+			continue
+		}
+		pressures[resource] = pressure
+		for kind, fields := range pressure {
+			for field, value := range fields {
+				if field == "total" {
+					samples = append(samples, telemetry.Sample{
+						Name:   "bunny_cgroup_pressure_stalled_seconds_total",
+						Labels: map[string]string{"probe": probeName, "resource": resource, "kind": kind},
+						Value:  value / 1000000,
+					})
+				} else if window, ok := cgroupPressureWindows[field]; ok {
+					samples = append(samples, telemetry.Sample{
+						Name:   "bunny_cgroup_pressure_ratio",
+						Labels: map[string]string{"probe": probeName, "resource": resource, "kind": kind, "window": window},
+						Value:  value / 100,
+					})
+				}
+			}
+		}
+	}
+
+	var sampleLabels map[string]string = map[string]string{"probe": probeName}
+	memoryCurrent, memoryCurrentErr := readValueFile(filepath.Join(action.path, "memory.current"))
+	if memoryCurrentErr == nil {
+		samples = append(samples, telemetry.Sample{Name: "bunny_cgroup_memory_current_bytes", Labels: sampleLabels, Value: memoryCurrent})
+		(*span).SetAttributes(attribute.Float64("bunny.cgroup.memory.current", memoryCurrent))
+	}
+	// "max" means that there's no limit, which isn't recorded
+	memoryMax, memoryMaxErr := readValueFile(filepath.Join(action.path, "memory.max"))
+	if memoryMaxErr == nil {
+		samples = append(samples, telemetry.Sample{Name: "bunny_cgroup_memory_max_bytes", Labels: sampleLabels, Value: memoryMax})
+		(*span).SetAttributes(attribute.Float64("bunny.cgroup.memory.max", memoryMax))
+	}
+
+	cpuStat, err := readCgroupFlatKeyed(filepath.Join(action.path, "cpu.stat"))
+	if err != nil {
+		logger.Debug("could not read cpu.stat", "err", err)
+	} else {
+		// the times in cpu.stat are in microseconds
+		for field, name := range map[string]string{
+			"usage_usec":     "bunny_cgroup_cpu_usage_seconds_total",
+			"nr_periods":     "bunny_cgroup_cpu_periods_total",
+			"nr_throttled":   "bunny_cgroup_cpu_throttled_periods_total",
+			"throttled_usec": "bunny_cgroup_cpu_throttled_seconds_total",
+		} {
+			value, ok := cpuStat[field]
+			if !ok {
+				continue
+			}
+			if strings.HasSuffix(field, "_usec") {
+				value = value / 1000000
+			}
+			samples = append(samples, telemetry.Sample{Name: name, Labels: sampleLabels, Value: value})
+		}
+	}
+	appendSamples(samples, now)
+
+	if action.maxMemoryUsageRatio != nil {
+		if memoryCurrentErr != nil || memoryMaxErr != nil {
+			return "probe failed - could not read memory.current and memory.max"
+		}
+		ratio := memoryCurrent / memoryMax
+		if ratio > *action.maxMemoryUsageRatio {
+			return fmt.Sprintf("probe failed - memory usage is %.2f of memory.max", ratio)
+		}
+	}
+	for _, threshold := range action.maxPressure {
+		value, ok := pressures[threshold.resource][threshold.kind][threshold.window]
+		if !ok {
+			return fmt.Sprintf("probe failed - no %v %v pressure for %v", threshold.kind, threshold.window, threshold.resource)
+		}
+		if value > threshold.percent {
+			return fmt.Sprintf("probe failed - %v %v pressure for %v is %.2f%%", threshold.kind, threshold.window, threshold.resource, value)
+		}
+	}
+	return ""
+}
+
+// pressure files have a line for each kind (some and full), like "some avg10=0.00 avg60=0.00 avg300=0.00 total=0"
+func readCgroupPressure(path string) (map[string]map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var pressure map[string]map[string]float64 = map[string]map[string]float64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var values map[string]float64 = map[string]float64{}
+		for _, field := range fields[1:] {
+			name, valueString, found := strings.Cut(field, "=")
+			if !found {
+				return nil, fmt.Errorf("bad field in %v: %q", path, field)
+			}
+			value, err := strconv.ParseFloat(valueString, 64)
+			if err != nil {
+				return nil, err
+			}
+			values[name] = value
+		}
+		pressure[fields[0]] = values
+	}
+	return pressure, scanner.Err()
+}
+
+// for files with a single value, like memory.current or /proc/sys/net/core/somaxconn
+func readValueFile(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, errors.New("no limit")
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// for files with a "key value" pair on each line, like cpu.stat
+func readCgroupFlatKeyed(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]float64 = map[string]float64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,36 @@
+package egress
+
+import (
+	"bunny/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewCgroupActionPath(t *testing.T) {
+	cgroupPath := t.TempDir()
+	err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.controllers"), []byte("cpu io memory\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		path  *string
+		valid bool
+	}{
+		{name: "cgroup", path: &cgroupPath, valid: true},
+		{name: "no path", path: nil, valid: false},
+		{name: "empty path", path: stringPointer(""), valid: false},
+		{name: "not a cgroup", path: stringPointer(t.TempDir()), valid: false},
+		{name: "missing", path: stringPointer(filepath.Join(cgroupPath, "missing")), valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := newCgroupAction(&config.CgroupActionConfig{Path: test.path}, time.Second)
+			if (action != nil) != test.valid {
+				t.Errorf("expected valid to be %v but it was %v", test.valid, action != nil)
+			}
+		})
+	}
+}
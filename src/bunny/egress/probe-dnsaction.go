@@ -0,0 +1,454 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type DNSAction struct {
+	name       dnsmessage.Name
+	recordType dnsmessage.Type
+	resolver   string
+	protocol   string
+	rcode      dnsmessage.RCode
+	minAnswers int
+	addresses  []net.IP
+	regex      *regexp.Regexp
+	minTTL     *uint32
+	maxTTL     *uint32
+	timeout    time.Duration
+}
+
+// an answer to the question, with its value converted to text so that it can be checked
+type DNSAnswer struct {
+	value string
+	ttl   uint32
+}
+
+var dnsRecordTypes map[string]dnsmessage.Type = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+var dnsRCodes map[string]dnsmessage.RCode = map[string]dnsmessage.RCode{
+	"NOERROR":  dnsmessage.RCodeSuccess,
+	"FORMERR":  dnsmessage.RCodeFormatError,
+	"SERVFAIL": dnsmessage.RCodeServerFailure,
+	"NXDOMAIN": dnsmessage.RCodeNameError,
+	"NOTIMP":   dnsmessage.RCodeNotImplemented,
+	"REFUSED":  dnsmessage.RCodeRefused,
+}
+
+// this is where glibc looks for the system's resolvers
+const resolvConfPath string = "/etc/resolv.conf"
+
+func newDNSAction(dnsActionConfig *config.DNSActionConfig, timeout time.Duration) *DNSAction {
+	logger.Info("processing dns probe config")
+	if dnsActionConfig == nil {
+		return nil
+	}
+
+	// names are always treated as fully qualified since the search list from resolv.conf isn't used
+	fqdn := dnsActionConfig.Name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn = fqdn + "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil || dnsActionConfig.Name == "" {
+		logger.Error("invalid name for dns action", "dnsActionConfig.Name", dnsActionConfig.Name, "err", err)
+		return nil
+	}
+
+	var recordType dnsmessage.Type = dnsmessage.TypeA
+	if dnsActionConfig.Type != nil {
+		var found bool
+		recordType, found = dnsRecordTypes[strings.ToUpper(*dnsActionConfig.Type)]
+		if !found {
+			logger.Error("unsupported record type for dns action", "dnsActionConfig.Type", *dnsActionConfig.Type)
+			return nil
+		}
+	}
+
+	// an empty resolver means that the system's resolver is looked up for each query
+	var resolver string = ""
+	if dnsActionConfig.Resolver != nil && *dnsActionConfig.Resolver != "" {
+		resolver = withDefaultDNSPort(*dnsActionConfig.Resolver)
+	}
+
+	var protocol string = "udp"
+	if dnsActionConfig.Protocol != nil {
+		protocol = strings.ToLower(*dnsActionConfig.Protocol)
+		if protocol != "udp" && protocol != "tcp" {
+			logger.Error("protocol for dns action is neither udp nor tcp", "dnsActionConfig.Protocol", *dnsActionConfig.Protocol)
+			return nil
+		}
+	}
+
+	var rcode dnsmessage.RCode = dnsmessage.RCodeSuccess
+	if dnsActionConfig.RCode != nil {
+		var found bool
+		rcode, found = dnsRCodes[strings.ToUpper(*dnsActionConfig.RCode)]
+		if !found {
+			number, err := strconv.Atoi(*dnsActionConfig.RCode)
+			if err != nil {
+				logger.Error("unknown rcode for dns action", "dnsActionConfig.RCode", *dnsActionConfig.RCode)
+				return nil
+			}
+			// the rcode in the header is 4 bits, so anything outside of that could never match
+			if number < 0 || number > 15 {
+				logger.Error("rcode for dns action is out of range", "dnsActionConfig.RCode", *dnsActionConfig.RCode)
+				return nil
+			}
+			rcode = dnsmessage.RCode(number)
+		}
+	}
+
+	// by default, a successful lookup has to have at least one answer
+	var minAnswers int = 0
+	if rcode == dnsmessage.RCodeSuccess {
+		minAnswers = 1
+	}
+	if dnsActionConfig.MinAnswers != nil {
+		minAnswers = *dnsActionConfig.MinAnswers
+	}
+
+	var addresses []net.IP = []net.IP{}
+	for _, address := range dnsActionConfig.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			logger.Error("invalid ip address for dns action", "address", address)
+			return nil
+		}
+		addresses = append(addresses, ip)
+	}
+
+	var regex *regexp.Regexp = nil
+	if dnsActionConfig.RegEx != nil {
+		regex, err = regexp.Compile(*dnsActionConfig.RegEx)
+		if err != nil {
+			logger.Error("error in regex for dns action", "dnsActionConfig.RegEx", *dnsActionConfig.RegEx, "err", err)
+			return nil
+		}
+	}
+
+	// TTLs are unsigned 32 bit numbers, so anything outside of that would wrap around when converted
+	var minTTL *uint32 = nil
+	if dnsActionConfig.MinTTLSeconds != nil {
+		if *dnsActionConfig.MinTTLSeconds < 0 || int64(*dnsActionConfig.MinTTLSeconds) > math.MaxUint32 {
+			logger.Error("minTTLSeconds for dns action is out of range", "dnsActionConfig.MinTTLSeconds", *dnsActionConfig.MinTTLSeconds)
+			return nil
+		}
+		ttl := uint32(*dnsActionConfig.MinTTLSeconds)
+		minTTL = &ttl
+	}
+	var maxTTL *uint32 = nil
+	if dnsActionConfig.MaxTTLSeconds != nil {
+		if *dnsActionConfig.MaxTTLSeconds < 0 || int64(*dnsActionConfig.MaxTTLSeconds) > math.MaxUint32 {
+			logger.Error("maxTTLSeconds for dns action is out of range", "dnsActionConfig.MaxTTLSeconds", *dnsActionConfig.MaxTTLSeconds)
+			return nil
+		}
+		ttl := uint32(*dnsActionConfig.MaxTTLSeconds)
+		maxTTL = &ttl
+	}
+
+	return &DNSAction{
+		name:       name,
+		recordType: recordType,
+		resolver:   resolver,
+		protocol:   protocol,
+		rcode:      rcode,
+		minAnswers: minAnswers,
+		addresses:  addresses,
+		regex:      regex,
+		minTTL:     minTTL,
+		maxTTL:     maxTTL,
+		timeout:    timeout,
+	}
+}
+
+func (action DNSAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing dns probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "dns-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
+
+	resolver := action.resolver
+	if resolver == "" {
+		resolver = systemDNSResolver()
+	}
+	span.SetAttributes(
+		attribute.String("dns.question.name", action.name.String()),
+		attribute.String("dns.question.type", strings.TrimPrefix(action.recordType.String(), "Type")),
+		attribute.String("bunny.dns.resolver", resolver),
+	)
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	header, answers, err := action.query(spanContext, resolver, timeoutTime)
+	if err != nil {
+		message := "probe failed - dns query failed"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "resolver", resolver, "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	span.SetAttributes(
+		attribute.String("dns.response.rcode", dnsRCodeName(header.RCode)),
+		attribute.Int("dns.answer.count", len(answers)),
+	)
+
+	message := action.check(header, answers)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "answers", answers)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// returns an empty message if the response passes all of the checks and a message explaining why if it doesn't
+func (action DNSAction) check(header dnsmessage.Header, answers []DNSAnswer) string {
+	if header.RCode != action.rcode {
+		return fmt.Sprintf("probe failed - unexpected rcode: %v", dnsRCodeName(header.RCode))
+	}
+	if len(answers) < action.minAnswers {
+		return fmt.Sprintf("probe failed - too few answers: %v", len(answers))
+	}
+	for _, address := range action.addresses {
+		found := false
+		for _, answer := range answers {
+			if address.Equal(net.ParseIP(answer.value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("probe failed - address not in answers: %v", address)
+		}
+	}
+	if action.regex != nil {
+		matched := false
+		for _, answer := range answers {
+			if action.regex.MatchString(answer.value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "probe failed - no answer matched regex"
+		}
+	}
+	for _, answer := range answers {
+		if action.minTTL != nil && answer.ttl < *action.minTTL {
+			return fmt.Sprintf("probe failed - ttl below minimum: %v", answer.ttl)
+		}
+		if action.maxTTL != nil && answer.ttl > *action.maxTTL {
+			return fmt.Sprintf("probe failed - ttl above maximum: %v", answer.ttl)
+		}
+	}
+	return ""
+}
+
+// sends the question to the resolver and returns the answers which are of the type that was asked for
+// (so that CNAMEs followed by the resolver don't count as answers to an A query)
+func (action DNSAction) query(ctx context.Context, resolver string, deadline time.Time) (dnsmessage.Header, []DNSAnswer, error) {
+	idBytes := make([]byte, 2)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	err = builder.StartQuestions()
+	if err == nil {
+		err = builder.Question(dnsmessage.Question{Name: action.name, Type: action.recordType, Class: dnsmessage.ClassINET})
+	}
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	request, err := builder.Finish()
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+
+	response, err := exchangeDNSMessage(ctx, action.protocol, resolver, request, deadline)
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	// like the Go resolver, retry over tcp when the udp response didn't fit in a datagram
+	if header.Truncated && action.protocol == "udp" {
+		logger.Debug("dns response truncated - retrying over tcp")
+		response, err = exchangeDNSMessage(ctx, "tcp", resolver, request, deadline)
+		if err != nil {
+			return dnsmessage.Header{}, nil, err
+		}
+		header, err = parser.Start(response)
+		if err != nil {
+			return dnsmessage.Header{}, nil, err
+		}
+	}
+	if header.ID != id || !header.Response {
+		return dnsmessage.Header{}, nil, errors.New("dns response does not match query")
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	resources, err := parser.AllAnswers()
+	if err != nil {
+		return dnsmessage.Header{}, nil, err
+	}
+	var answers []DNSAnswer = []DNSAnswer{}
+	for _, resource := range resources {
+		if resource.Header.Type != action.recordType {
+			continue
+		}
+		answers = append(answers, DNSAnswer{
+			value: dnsResourceValue(resource.Body),
+			ttl:   resource.Header.TTL,
+		})
+	}
+	return header, answers, nil
+}
+
+func exchangeDNSMessage(ctx context.Context, protocol string, resolver string, request []byte, deadline time.Time) ([]byte, error) {
+	dialer := newDialer()
+	dialer.Timeout = time.Until(deadline)
+	connection, err := dialer.DialContext(ctx, protocol, resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	connection.SetDeadline(deadline)
+
+	if protocol == "udp" {
+		_, err = connection.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		response := make([]byte, maxDatagramBytes)
+		bytesRead, err := connection.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:bytesRead], nil
+	}
+
+	// over tcp, each message is prefixed with its length
+	_, err = connection.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(request))), request...))
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 2)
+	_, err = io.ReadFull(connection, prefix)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(prefix))
+	_, err = io.ReadFull(connection, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func dnsResourceValue(body dnsmessage.ResourceBody) string {
+	switch resource := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(resource.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(resource.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return resource.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%v %v", resource.Pref, resource.MX.String())
+	case *dnsmessage.NSResource:
+		return resource.NS.String()
+	case *dnsmessage.PTRResource:
+		return resource.PTR.String()
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%v %v %v %v", resource.Priority, resource.Weight, resource.Port, resource.Target.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(resource.TXT, "")
+	}
+	return body.GoString()
+}
+
+func dnsRCodeName(rcode dnsmessage.RCode) string {
+	for name, value := range dnsRCodes {
+		if value == rcode {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", rcode)
+}
+
+func withDefaultDNSPort(resolver string) string {
+	_, _, err := net.SplitHostPort(resolver)
+	if err != nil {
+		return net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+	}
+	return resolver
+}
+
+// uses the first nameserver in resolv.conf (which is what glibc tries first) and falls back to localhost like glibc does
+// this is read for each query so that changes to the file are picked up
+func systemDNSResolver() string {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		logger.Debug("could not open resolv.conf - using localhost", "err", err)
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return withDefaultDNSPort(fields[1])
+		}
+	}
+	return "127.0.0.1:53"
+}
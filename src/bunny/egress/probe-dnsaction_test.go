@@ -0,0 +1,185 @@
+package egress
+
+import (
+	"bunny/config"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answers for the fake dns server
+// "cname.example." has a CNAME (which isn't an answer to an A query) before its A record,
+// "big.example." is truncated over udp so that the client has to retry over tcp, and anything else is NXDOMAIN
+func fakeDNSResponse(request []byte, overTCP bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(request)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	responseHeader := dnsmessage.Header{ID: header.ID, Response: true, RecursionDesired: header.RecursionDesired, RecursionAvailable: true}
+	var answers []dnsmessage.Resource = []dnsmessage.Resource{}
+	a := func(ttl uint32, address [4]byte) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: address},
+		}
+	}
+	switch question.Name.String() {
+	case "app.example.":
+		answers = append(answers, a(300, [4]byte{10, 0, 0, 1}), a(300, [4]byte{10, 0, 0, 2}))
+	case "cname.example.":
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("app.example.")},
+		}, a(30, [4]byte{10, 0, 0, 3}))
+	case "big.example.":
+		if overTCP {
+			answers = append(answers, a(300, [4]byte{10, 0, 0, 4}))
+		} else {
+			responseHeader.Truncated = true
+		}
+	default:
+		responseHeader.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, responseHeader)
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			builder.AResource(answer.Header, *body)
+		case *dnsmessage.CNAMEResource:
+			builder.CNAMEResource(answer.Header, *body)
+		}
+	}
+	response, _ := builder.Finish()
+	return response
+}
+
+// starts the fake dns server on the same port for udp and tcp, returning the address
+func startFakeDNSServer(t *testing.T) string {
+	t.Helper()
+	var udpConnection net.PacketConn
+	var tcpListener net.Listener
+	// the port that was free for udp might not be for tcp
+	for i := 0; i < 10 && tcpListener == nil; i++ {
+		var err error
+		udpConnection, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen on udp: %v", err)
+		}
+		tcpListener, err = net.Listen("tcp", udpConnection.LocalAddr().String())
+		if err != nil {
+			udpConnection.Close()
+		}
+	}
+	if tcpListener == nil {
+		t.Fatal("could not listen on tcp")
+	}
+	t.Cleanup(func() {
+		udpConnection.Close()
+		tcpListener.Close()
+	})
+
+	go func() {
+		buffer := make([]byte, maxDatagramBytes)
+		for {
+			bytesRead, address, err := udpConnection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpConnection.WriteTo(fakeDNSResponse(buffer[:bytesRead], false), address)
+		}
+	}()
+	go func() {
+		for {
+			connection, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				prefix := make([]byte, 2)
+				if _, err := io.ReadFull(connection, prefix); err != nil {
+					return
+				}
+				request := make([]byte, binary.BigEndian.Uint16(prefix))
+				if _, err := io.ReadFull(connection, request); err != nil {
+					return
+				}
+				response := fakeDNSResponse(request, true)
+				connection.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}()
+		}
+	}()
+	return udpConnection.LocalAddr().String()
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestDNSAction(t *testing.T) {
+	resolver := startFakeDNSServer(t)
+	tests := []struct {
+		name    string
+		config  config.DNSActionConfig
+		success bool
+	}{
+		{name: "answers", config: config.DNSActionConfig{Name: "app.example"}, success: true},
+		{name: "tcp", config: config.DNSActionConfig{Name: "app.example", Protocol: stringPointer("tcp")}, success: true},
+		{name: "nxdomain", config: config.DNSActionConfig{Name: "missing.example"}, success: false},
+		{name: "expected nxdomain", config: config.DNSActionConfig{Name: "missing.example", RCode: stringPointer("NXDOMAIN")}, success: true},
+		{name: "unexpected rcode", config: config.DNSActionConfig{Name: "app.example", RCode: stringPointer("NXDOMAIN")}, success: false},
+		{name: "rcode by number", config: config.DNSActionConfig{Name: "missing.example", RCode: stringPointer("3")}, success: true},
+		{name: "min answers", config: config.DNSActionConfig{Name: "app.example", MinAnswers: intPointer(2)}, success: true},
+		{name: "too few answers", config: config.DNSActionConfig{Name: "app.example", MinAnswers: intPointer(3)}, success: false},
+		{name: "cname is not an answer", config: config.DNSActionConfig{Name: "cname.example", MinAnswers: intPointer(2)}, success: false},
+		{name: "addresses", config: config.DNSActionConfig{Name: "app.example", Addresses: []string{"10.0.0.2", "10.0.0.1"}}, success: true},
+		{name: "address missing", config: config.DNSActionConfig{Name: "app.example", Addresses: []string{"10.0.0.9"}}, success: false},
+		{name: "regex", config: config.DNSActionConfig{Name: "app.example", RegEx: stringPointer(`^10\.0\.0\.2$`)}, success: true},
+		{name: "regex does not match", config: config.DNSActionConfig{Name: "app.example", RegEx: stringPointer(`^192\.`)}, success: false},
+		{name: "ttl in bounds", config: config.DNSActionConfig{Name: "app.example", MinTTLSeconds: intPointer(60), MaxTTLSeconds: intPointer(300)}, success: true},
+		{name: "ttl below minimum", config: config.DNSActionConfig{Name: "cname.example", MinTTLSeconds: intPointer(60)}, success: false},
+		{name: "ttl above maximum", config: config.DNSActionConfig{Name: "app.example", MaxTTLSeconds: intPointer(299)}, success: false},
+		{name: "truncated retried over tcp", config: config.DNSActionConfig{Name: "big.example", Addresses: []string{"10.0.0.4"}}, success: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dnsActionConfig := test.config
+			dnsActionConfig.Resolver = &resolver
+			action := newDNSAction(&dnsActionConfig, time.Second)
+			if action == nil {
+				t.Fatal("could not create dns action")
+			}
+			success := action.act(context.Background(), test.name, nil, nil, nil)
+			if success != test.success {
+				t.Errorf("expected success to be %v but it was %v", test.success, success)
+			}
+		})
+	}
+}
+
+func TestDNSActionRejectsOutOfRangeConfig(t *testing.T) {
+	for _, dnsActionConfig := range []config.DNSActionConfig{
+		{Name: "app.example", MinTTLSeconds: intPointer(-1)},
+		{Name: "app.example", MaxTTLSeconds: intPointer(-1)},
+		{Name: "app.example", RCode: stringPointer("-1")},
+		{Name: "app.example", RCode: stringPointer("16")},
+	} {
+		if newDNSAction(&dnsActionConfig, time.Second) != nil {
+			t.Errorf("expected config to be rejected: %+v", dnsActionConfig)
+		}
+	}
+}
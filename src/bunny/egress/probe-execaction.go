@@ -4,8 +4,14 @@ import (
 	"bunny/config"
 	"bunny/telemetry"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -13,16 +19,42 @@ import (
 )
 
 type ExecAction struct {
-	command []string
-	env     []string
-	timeout time.Duration
+	command            []string
+	env                []string
+	workingDir         string
+	successExitCodes   map[int]bool
+	outputLimitBytes   int
+	outputLabelBytes   int
+	stdoutRegex        *regexp.Regexp
+	jsonPathAssertions []JSONPathAssertion
+	exitCodesMetric    *telemetry.LabelledCounterMetric
+	sandbox            *ExecSandbox
+	forwardOtelEnv     bool
+	spansFD            int
+	expectSteps        []ExpectStep
+	timeout            time.Duration
 }
 
-func newExecAction(execActionConfig *config.ExecActionConfig, timeout time.Duration) *ExecAction {
+// like the kubelet, we only keep the start of what a program writes so that noisy programs can't use up our memory
+// see: https://github.com/kubernetes/kubernetes/blob/master/pkg/probe/exec/exec.go
+const defaultExecOutputLimitBytes int = 10 * 1024
+
+func newExecAction(execActionConfig *config.ExecActionConfig, execAllowlist []string, exitCodesMetricsConfig *config.MetricsConfig, timeout time.Duration) *ExecAction {
 	logger.Info("processing exec probe config")
 	if execActionConfig == nil {
 		return nil
 	}
+	if len(execActionConfig.Command) == 0 {
+		logger.Error("command for exec action is empty")
+		return nil
+	}
+	if !checkExecAllowlist(execActionConfig.Command[0], execAllowlist) {
+		return nil
+	}
+	sandbox := newExecSandbox(execActionConfig)
+	if sandbox == nil {
+		return nil
+	}
 
 	// yes, this looks a bit strange but it's what exec.Cmd.Env needs
 	envSlice := []string{}
@@ -31,53 +63,283 @@ func newExecAction(execActionConfig *config.ExecActionConfig, timeout time.Durat
 		envSlice = append(envSlice, envSliceItem)
 	}
 
+	var workingDir string = ""
+	if execActionConfig.WorkingDir != nil {
+		workingDir = *execActionConfig.WorkingDir
+	}
+
+	var successExitCodes map[int]bool = map[int]bool{0: true}
+	if len(execActionConfig.SuccessExitCodes) > 0 {
+		successExitCodes = map[int]bool{}
+		for _, exitCode := range execActionConfig.SuccessExitCodes {
+			successExitCodes[exitCode] = true
+		}
+	}
+
+	var outputLimitBytes int = defaultExecOutputLimitBytes
+	if execActionConfig.OutputLimitBytes != nil {
+		outputLimitBytes = *execActionConfig.OutputLimitBytes
+		if outputLimitBytes <= 0 {
+			logger.Error("outputLimitBytes for exec action must be greater than zero", "execActionConfig.OutputLimitBytes", outputLimitBytes)
+			return nil
+		}
+	}
+
+	var stdoutRegex *regexp.Regexp = nil
+	var jsonPathAssertions []JSONPathAssertion = []JSONPathAssertion{}
+	if execActionConfig.Stdout != nil {
+		if execActionConfig.Stdout.RegEx != nil {
+			var err error
+			stdoutRegex, err = regexp.Compile(*execActionConfig.Stdout.RegEx)
+			if err != nil {
+				logger.Error("error in regex for exec action stdout", "execActionConfig.Stdout.RegEx", *execActionConfig.Stdout.RegEx, "err", err)
+				return nil
+			}
+		}
+		var ok bool
+		jsonPathAssertions, ok = newJSONPathAssertions(execActionConfig.Stdout.JSONPath)
+		if !ok {
+			return nil
+		}
+	}
+
+	// when there are expect steps, the conversation uses stdout, so there's nothing left to check or capture
+	var expectSteps []ExpectStep = nil
+	if execActionConfig.Expect != nil {
+		if execActionConfig.Stdout != nil || execActionConfig.OutputLabelBytes > 0 {
+			logger.Error("stdout and outputLabelBytes can't be used with expect for exec action")
+			return nil
+		}
+		var ok bool
+		expectSteps, ok = newExpectSteps(*execActionConfig.Expect)
+		if !ok {
+			logger.Error("could not process expect steps for exec probe config")
+			return nil
+		}
+	}
+
+	// fds 0 to 2 are stdin, stdout, and stderr
+	var spansFD int = 0
+	if execActionConfig.SpansFD != nil {
+		spansFD = *execActionConfig.SpansFD
+		if spansFD < 3 || spansFD > 255 {
+			logger.Error("spansFileDescriptor for exec action must be between 3 and 255", "spansFD", spansFD)
+			return nil
+		}
+	}
+
+	// the output label is only added when asked for since every different output creates a new time series
+	var labelNames []string = []string{"exit_code"}
+	if execActionConfig.OutputLabelBytes > 0 {
+		labelNames = append(labelNames, "output")
+	}
+
 	return &ExecAction{
-		command: execActionConfig.Command,
-		env:     envSlice,
-		timeout: timeout,
+		command:            execActionConfig.Command,
+		env:                envSlice,
+		workingDir:         workingDir,
+		successExitCodes:   successExitCodes,
+		outputLimitBytes:   outputLimitBytes,
+		outputLabelBytes:   execActionConfig.OutputLabelBytes,
+		stdoutRegex:        stdoutRegex,
+		jsonPathAssertions: jsonPathAssertions,
+		exitCodesMetric:    telemetry.NewLabelledCounterMetric(exitCodesMetricsConfig, labelNames, meter),
+		sandbox:            sandbox,
+		forwardOtelEnv:     execActionConfig.ForwardOtelEnv,
+		spansFD:            spansFD,
+		expectSteps:        expectSteps,
+		timeout:            timeout,
 	}
 }
 
-func (action ExecAction) act(probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) {
+func (action ExecAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
 	logger.Debug("performing exec probe")
-	// need to run this on a separate goroutine since the timeout could be greater than the period
-	go func() {
-		timeoutTime := time.Now().Add(action.timeout)
-		timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(context.Background(), timeoutTime, context.DeadlineExceeded)
-		defer timeoutContextCancelFunc()
-
-		// create the span
-		spanContext, span := (*tracer).Start(timeoutContext, "exec-probe")
-		span.SetAttributes(attribute.KeyValue{
-			Key:   "bunny-probe-name",
-			Value: attribute.StringValue(probeName),
-		})
-		defer span.End()
-
-		// setup the environment variables
-		// get the trace id (so that we can pass it to otel-cli)
-		traceID := span.SpanContext().TraceID()
-		tranceParent := "OTEL_CLI_FORCE_TRACE_ID=" + traceID.String()
-		newEnvVars := append(action.env, tranceParent)
-
-		// run the program
-		// TODO-MEDIUM: does this fail if no args are provided to the command?
-		cmd := exec.CommandContext(spanContext, action.command[0], action.command[1:]...)
-		cmd.Env = newEnvVars
-		timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
-		output, err := cmd.CombinedOutput()
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "exec-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
+
+	// setup the environment variables
+	// later env vars win, so the probe's env overrides Bunny's OTEL_* env vars but not the trace context
+	var newEnvVars []string = []string{}
+	if action.forwardOtelEnv {
+		newEnvVars = append(newEnvVars, newExecOtelEnv()...)
+	}
+	newEnvVars = append(newEnvVars, action.env...)
+	newEnvVars = append(newEnvVars, newExecTraceContextEnv(spanContext, &span)...)
+
+	// run the program
+	cmd := action.sandbox.command(spanContext, action.command)
+	cmd.Dir = action.workingDir
+	stdout := &LimitedBuffer{limit: action.outputLimitBytes}
+	stderr := &LimitedBuffer{limit: action.outputLimitBytes}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	var pipeConnection *PipeConnection = nil
+	if action.expectSteps != nil {
+		var err error
+		pipeConnection, err = newPipeConnection()
 		if err != nil {
-			message := "probe failed - error while running command"
-			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
-			logger.Debug(message, "err", err, "output", string(output))
+			message := "probe failed - could not create pipes for expect steps"
+			logger.Error(message, "err", err)
 			span.SetStatus(codes.Error, message)
-			return
+			return false
 		}
-		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
-		message := "probe succeeded"
-		// TODO-LOW: limit the amount of stdout and stderr to limit memory usage from incredibly noisy exec programs/scripts
-		// see how Kubernetes does this for their version of the exec probe action
-		logger.Debug(message, "cmd.Path", cmd.Path, "cmd.Args", cmd.Args, "output", string(output))
-		span.SetStatus(codes.Ok, message)
-	}()
+		defer pipeConnection.Close()
+		pipeConnection.attach(cmd)
+	}
+	var spansReader *os.File = nil
+	if action.spansFD > 0 {
+		var spansWriter *os.File
+		var err error
+		spansReader, spansWriter, err = os.Pipe()
+		if err != nil {
+			logger.Error("could not create pipe for spans from exec probe", "err", err)
+		} else {
+			// ExtraFiles starts at fd 3 and any fds before ours are left closed
+			cmd.ExtraFiles = make([]*os.File, action.spansFD-2)
+			cmd.ExtraFiles[action.spansFD-3] = spansWriter
+			newEnvVars = append(newEnvVars, fmt.Sprintf("BUNNY_SPANS_FD=%v", action.spansFD))
+			defer spansReader.Close()
+			defer spansWriter.Close()
+		}
+	}
+	cmd.Env = newEnvVars
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	err := cmd.Start()
+	var spansChannel chan []otlpJSONSpan = nil
+	var expectSuccess bool = true
+	if err == nil {
+		if spansReader != nil {
+			// our copy of the writer has to be closed so that the reader sees the end when the program is done
+			cmd.ExtraFiles[action.spansFD-3].Close()
+			spansChannel = make(chan []otlpJSONSpan, 1)
+			go func() {
+				spansChannel <- readExecSpans(spansReader, timeoutTime)
+			}()
+		}
+		if pipeConnection != nil {
+			pipeConnection.started()
+			pipeConnection.SetDeadline(timeoutTime)
+			expectSuccess = expect(spanContext, pipeConnection, "localhost", timeoutTime, action.expectSteps, &span)
+			if !expectSuccess {
+				// there's no point waiting for the program to finish since the probe has already failed
+				killProcessGroup(cmd)
+			}
+			pipeConnection.finish(timeoutTime)
+		}
+		err = cmd.Wait()
+	}
+	// anything the program left running in the background is killed too
+	killProcessGroup(cmd)
+	if spansChannel != nil {
+		exportExecSpans(spanContext, <-spansChannel)
+	}
+
+	// programs which ran but exited with a non-zero exit code aren't errors for us (yet)
+	// and neither are programs which exited while something they started still had their output open
+	exitCode := -1
+	var exitError *exec.ExitError
+	if err == nil || errors.As(err, &exitError) || (errors.Is(err, exec.ErrWaitDelay) && cmd.ProcessState != nil) {
+		exitCode = cmd.ProcessState.ExitCode()
+		err = nil
+	}
+	span.SetAttributes(
+		attribute.Int("process.exit.code", exitCode),
+		attribute.String("bunny.exec.stdout", truncateForSpan(stdout.Bytes())),
+		attribute.String("bunny.exec.stderr", truncateForSpan(stderr.Bytes())),
+		attribute.Bool("bunny.exec.stdout.truncated", stdout.truncated),
+		attribute.Bool("bunny.exec.stderr.truncated", stderr.truncated),
+	)
+	action.incExitCodesMetric(exitCode, stdout.Bytes())
+
+	message := ""
+	if !expectSuccess {
+		message = "probe failed - expect steps failed"
+	} else if spanContext.Err() != nil {
+		message = "probe failed - command timed out"
+	} else if err != nil {
+		message = "probe failed - error while running command"
+	} else if !action.successExitCodes[exitCode] {
+		message = fmt.Sprintf("probe failed - unexpected exit code: %v", exitCode)
+	} else {
+		message = action.checkStdout(stdout.Bytes())
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "err", err, "exitCode", exitCode, "stdout", stdout.String(), "stderr", stderr.String())
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message, "cmd.Path", cmd.Path, "cmd.Args", cmd.Args, "stdout", stdout.String(), "stderr", stderr.String())
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// returns an empty message if stdout passes the checks and a message explaining why if it doesn't
+func (action ExecAction) checkStdout(stdout []byte) string {
+	if action.stdoutRegex != nil && !action.stdoutRegex.Match(stdout) {
+		return "probe failed - stdout did not match regex"
+	}
+	if len(action.jsonPathAssertions) == 0 {
+		return ""
+	}
+	var data interface{}
+	err := json.Unmarshal(stdout, &data)
+	if err != nil {
+		logger.Debug("could not parse stdout as json", "err", err)
+		return "probe failed - stdout is not json"
+	}
+	if !checkJSONPathAssertions(action.jsonPathAssertions, data) {
+		return "probe failed - jsonPath assertions failed"
+	}
+	return ""
+}
+
+func (action ExecAction) incExitCodesMetric(exitCode int, stdout []byte) {
+	labelValues := []string{strconv.Itoa(exitCode)}
+	if action.outputLabelBytes > 0 {
+		output := stdout
+		if len(output) > action.outputLabelBytes {
+			output = output[:action.outputLabelBytes]
+		}
+		labelValues = append(labelValues, strings.TrimSpace(strings.ToValidUTF8(string(output), "")))
+	}
+	telemetry.IncLabelledCounter(action.exitCodesMetric, labelValues...)
+}
+
+// keeps the first limit bytes written to it and throws away the rest
+// writes never fail so that the program isn't stopped (or blocked) by having too much output
+type LimitedBuffer struct {
+	buffer    []byte
+	limit     int
+	truncated bool
+}
+
+func (limitedBuffer *LimitedBuffer) Write(data []byte) (int, error) {
+	space := limitedBuffer.limit - len(limitedBuffer.buffer)
+	if len(data) > space {
+		limitedBuffer.buffer = append(limitedBuffer.buffer, data[:space]...)
+		limitedBuffer.truncated = true
+	} else {
+		limitedBuffer.buffer = append(limitedBuffer.buffer, data...)
+	}
+	return len(data), nil
+}
+
+func (limitedBuffer *LimitedBuffer) Bytes() []byte {
+	return limitedBuffer.buffer
+}
+
+func (limitedBuffer *LimitedBuffer) String() string {
+	return string(limitedBuffer.buffer)
 }
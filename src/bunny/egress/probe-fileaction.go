@@ -0,0 +1,242 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type FileAction struct {
+	path           string
+	exists         bool
+	maxAge         time.Duration
+	minSizeBytes   *int64
+	maxSizeBytes   *int64
+	regex          *regexp.Regexp
+	readLimitBytes int
+	minFreeBytes   *uint64
+	minFreeInodes  *uint64
+	timeout        time.Duration
+}
+
+// how much of the file is checked against the regex unless readLimitBytes is set
+const defaultFileReadLimitBytes int = 1024 * 1024
+
+func newFileAction(fileActionConfig *config.FileActionConfig, timeout time.Duration) *FileAction {
+	logger.Info("processing file probe config")
+	if fileActionConfig == nil {
+		return nil
+	}
+
+	if fileActionConfig.Path == "" {
+		logger.Error("path must be set for file action")
+		return nil
+	}
+	var exists bool = true
+	if fileActionConfig.Exists != nil {
+		exists = *fileActionConfig.Exists
+	}
+	if !exists && (fileActionConfig.MaxAgeMilliseconds != nil || fileActionConfig.MinSizeBytes != nil || fileActionConfig.MaxSizeBytes != nil || fileActionConfig.RegEx != nil) {
+		logger.Error("maxAgeMilliseconds, minSizeBytes, maxSizeBytes, and regex can't be used when exists is false for file action")
+		return nil
+	}
+	var maxAge time.Duration = 0
+	if fileActionConfig.MaxAgeMilliseconds != nil {
+		if *fileActionConfig.MaxAgeMilliseconds <= 0 {
+			logger.Error("maxAgeMilliseconds must be greater than 0 for file action", "fileActionConfig.MaxAgeMilliseconds", *fileActionConfig.MaxAgeMilliseconds)
+			return nil
+		}
+		maxAge = time.Duration(*fileActionConfig.MaxAgeMilliseconds) * time.Millisecond
+	}
+	var regex *regexp.Regexp = nil
+	if fileActionConfig.RegEx != nil {
+		var err error
+		regex, err = regexp.Compile(*fileActionConfig.RegEx)
+		if err != nil {
+			logger.Error("error in regex for file action", "fileActionConfig.RegEx", *fileActionConfig.RegEx, "err", err)
+			return nil
+		}
+	}
+	var readLimitBytes int = defaultFileReadLimitBytes
+	if fileActionConfig.ReadLimitBytes != nil {
+		if *fileActionConfig.ReadLimitBytes <= 0 {
+			logger.Error("readLimitBytes must be greater than 0 for file action", "fileActionConfig.ReadLimitBytes", *fileActionConfig.ReadLimitBytes)
+			return nil
+		}
+		readLimitBytes = *fileActionConfig.ReadLimitBytes
+	}
+
+	return &FileAction{
+		path:           fileActionConfig.Path,
+		exists:         exists,
+		maxAge:         maxAge,
+		minSizeBytes:   fileActionConfig.MinSizeBytes,
+		maxSizeBytes:   fileActionConfig.MaxSizeBytes,
+		regex:          regex,
+		readLimitBytes: readLimitBytes,
+		minFreeBytes:   fileActionConfig.MinFreeBytes,
+		minFreeInodes:  fileActionConfig.MinFreeInodes,
+		timeout:        timeout,
+	}
+}
+
+func (action FileAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing file probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "file-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("file.path", action.path))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	// file system calls can't be cancelled and can hang forever (like on an unreachable NFS server)
+	// so the check runs on its own goroutine that we stop waiting for at the timeout
+	messageChannel := make(chan string, 1)
+	go func() {
+		messageChannel <- action.check(probeName, &span)
+	}()
+	var message string
+	select {
+	case message = <-messageChannel:
+	case <-spanContext.Done():
+		message = "probe failed - timed out"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// measures the file and its file system, records the measurements in the local TSDB,
+// and then returns an empty message if the file passes all of the checks and a message explaining why if it doesn't
+func (action FileAction) check(probeName string, span *trace.Span) string {
+	now := time.Now()
+	var sampleLabels map[string]string = map[string]string{"probe": probeName, "path": action.path}
+	var samples []telemetry.Sample = []telemetry.Sample{}
+
+	fileInfo, err := os.Stat(action.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Debug("could not stat file", "path", action.path, "err", err)
+		return "probe failed - could not stat file"
+	}
+	exists := err == nil
+	samples = append(samples, telemetry.Sample{Name: "bunny_file_exists", Labels: sampleLabels, Value: boolToFloat(exists)})
+	(*span).SetAttributes(attribute.Bool("bunny.file.exists", exists))
+	var age time.Duration
+	if exists {
+		age = now.Sub(fileInfo.ModTime())
+		samples = append(samples,
+			telemetry.Sample{Name: "bunny_file_age_seconds", Labels: sampleLabels, Value: age.Seconds()},
+			telemetry.Sample{Name: "bunny_file_size_bytes", Labels: sampleLabels, Value: float64(fileInfo.Size())},
+		)
+		(*span).SetAttributes(
+			attribute.Int64("bunny.file.age_ms", age.Milliseconds()),
+			attribute.Int64("file.size", fileInfo.Size()),
+		)
+	}
+
+	// the file system that the file would be on is still useful to know about when the file doesn't exist
+	var usagePath = action.path
+	if !exists {
+		usagePath = filepath.Dir(action.path)
+	}
+	usage, err := disk.Usage(usagePath)
+	if err != nil {
+		logger.Debug("could not get file system usage", "usagePath", usagePath, "err", err)
+	} else {
+		samples = append(samples,
+			telemetry.Sample{Name: "bunny_filesystem_free_bytes", Labels: sampleLabels, Value: float64(usage.Free)},
+			telemetry.Sample{Name: "bunny_filesystem_size_bytes", Labels: sampleLabels, Value: float64(usage.Total)},
+			telemetry.Sample{Name: "bunny_filesystem_free_inodes", Labels: sampleLabels, Value: float64(usage.InodesFree)},
+		)
+		(*span).SetAttributes(
+			attribute.Int64("bunny.filesystem.free_bytes", int64(usage.Free)),
+			attribute.Int64("bunny.filesystem.free_inodes", int64(usage.InodesFree)),
+		)
+	}
+	appendSamples(samples, now)
+
+	if (action.minFreeBytes != nil || action.minFreeInodes != nil) && usage == nil {
+		return "probe failed - could not get file system usage"
+	}
+	if action.minFreeBytes != nil && usage.Free < *action.minFreeBytes {
+		return fmt.Sprintf("probe failed - only %v bytes free on file system", usage.Free)
+	}
+	if action.minFreeInodes != nil && usage.InodesFree < *action.minFreeInodes {
+		return fmt.Sprintf("probe failed - only %v inodes free on file system", usage.InodesFree)
+	}
+
+	if !action.exists {
+		if exists {
+			return "probe failed - file exists"
+		}
+		return ""
+	}
+	if !exists {
+		return "probe failed - file does not exist"
+	}
+	if action.maxAge > 0 && age > action.maxAge {
+		return fmt.Sprintf("probe failed - file was last modified %v ago", age.Round(time.Millisecond))
+	}
+	if action.minSizeBytes != nil && fileInfo.Size() < *action.minSizeBytes {
+		return fmt.Sprintf("probe failed - file is smaller than %v bytes", *action.minSizeBytes)
+	}
+	if action.maxSizeBytes != nil && fileInfo.Size() > *action.maxSizeBytes {
+		return fmt.Sprintf("probe failed - file is larger than %v bytes", *action.maxSizeBytes)
+	}
+	if action.regex != nil {
+		return action.checkContent()
+	}
+	return ""
+}
+
+func (action FileAction) checkContent() string {
+	file, err := os.Open(action.path)
+	if err != nil {
+		logger.Debug("could not open file", "path", action.path, "err", err)
+		return "probe failed - could not open file"
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, int64(action.readLimitBytes)))
+	if err != nil {
+		logger.Debug("could not read file", "path", action.path, "err", err)
+		return "probe failed - could not read file"
+	}
+	if !action.regex.Match(content) {
+		return "probe failed - file content did not match regex"
+	}
+	return ""
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
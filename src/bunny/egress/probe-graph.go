@@ -0,0 +1,122 @@
+package egress
+
+import (
+	"bunny/common"
+	"bunny/telemetry"
+	"time"
+)
+
+// puts each probe after the probes that it depends on
+// probes that depend on a probe that doesn't exist (including one whose config is invalid) are dropped,
+// as are probes in a cycle of dependencies (and the probes that depend on them) since they could never run
+func orderProbes(probes []Probe) []Probe {
+	// dropping a probe can leave the probes that depend on it without a dependency, so keep going until none are dropped
+	var remaining []Probe = probes
+	for {
+		var names map[string]bool = map[string]bool{}
+		for _, probe := range remaining {
+			names[probe.Name] = true
+		}
+		var kept []Probe = []Probe{}
+		for _, probe := range remaining {
+			missing := ""
+			for _, dependency := range probe.DependsOn {
+				if !names[dependency] {
+					missing = dependency
+					break
+				}
+			}
+			if missing != "" {
+				logger.Error("skipping probe that depends on a probe that doesn't exist or has an invalid config", "probe", probe.Name, "dependency", missing)
+				continue
+			}
+			kept = append(kept, probe)
+		}
+		if len(kept) == len(remaining) {
+			break
+		}
+		remaining = kept
+	}
+
+	// each pass adds the probes whose dependencies have all been added, so whatever is left when a pass adds nothing is in
+	// (or depends on) a cycle
+	var ordered []Probe = []Probe{}
+	var orderedNames map[string]bool = map[string]bool{}
+	var unordered []Probe = remaining
+	for len(unordered) > 0 {
+		var next []Probe = []Probe{}
+		for _, probe := range unordered {
+			var ready bool = true
+			for _, dependency := range probe.DependsOn {
+				if !orderedNames[dependency] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, probe)
+				orderedNames[probe.Name] = true
+			} else {
+				next = append(next, probe)
+			}
+		}
+		if len(next) == len(unordered) {
+			break
+		}
+		unordered = next
+	}
+	if len(ordered) < len(remaining) {
+		for _, probe := range unordered {
+			logger.Error("skipping probe that is in or depends on a cycle of dependencies", "probe", probe.Name, "dependsOn", probe.DependsOn)
+		}
+	}
+	return ordered
+}
+
+// replaces the probe graph, which forgets the outcomes of the probes from before the config was updated
+func newProbeGraph(probes []Probe) {
+	var probeGraph []common.ProbeGraphNode = []common.ProbeGraphNode{}
+	for _, probe := range probes {
+		probeGraph = append(probeGraph, common.ProbeGraphNode{Name: probe.Name, DependsOn: probe.DependsOn})
+	}
+	common.ProbeGraphMutex.Lock()
+	defer common.ProbeGraphMutex.Unlock()
+	common.ProbeGraph = probeGraph
+}
+
+// returns the first dependency that didn't succeed the last time it ran (or was skipped itself), or "" if the probe can run
+// dependencies that haven't run yet don't stop the probe from running
+func failedDependency(probe *Probe) string {
+	common.ProbeGraphMutex.Lock()
+	defer common.ProbeGraphMutex.Unlock()
+	for _, dependency := range probe.DependsOn {
+		for _, node := range common.ProbeGraph {
+			if node.Name == dependency && (node.LastOutcome == common.ProbeOutcomeFailure || node.LastOutcome == common.ProbeOutcomeSkippedDependency) {
+				return dependency
+			}
+		}
+	}
+	return ""
+}
+
+func recordProbeOutcome(probeName string, outcome string, skippedBecauseOf string) {
+	now := time.Now()
+	common.ProbeGraphMutex.Lock()
+	defer common.ProbeGraphMutex.Unlock()
+	// a probe that finishes after the config was updated is only recorded if it's still in the graph
+	for i := range common.ProbeGraph {
+		if common.ProbeGraph[i].Name == probeName {
+			common.ProbeGraph[i].LastOutcome = outcome
+			common.ProbeGraph[i].LastRunTime = &now
+			common.ProbeGraph[i].SkippedBecauseOf = skippedBecauseOf
+		}
+	}
+}
+
+// a skipped probe isn't attempted, so it doesn't add to attempts or to failures, and has no span
+// (when something that many probes depend on is down, only the probe for that thing fails)
+func skipProbe(probe *Probe, dependency string) {
+	logger.Debug("skipping probe since a probe it depends on did not succeed", "probe", probe.Name, "dependency", dependency)
+	telemetry.IncCounter(probe.SkippedDependenciesMetric)
+	recordProbeOutcome(probe.Name, common.ProbeOutcomeSkippedDependency, dependency)
+}
@@ -17,9 +17,11 @@ import (
 )
 
 type GRPCAction struct {
-	port    int
-	service *string
-	timeout time.Duration
+	port           int
+	unixSocketPath string
+	service        *string
+	method         *GRPCMethod
+	timeout        time.Duration
 }
 
 func newGRPCAction(grpcActionConfig *config.GRPCActionConfig, timeout time.Duration) *GRPCAction {
@@ -28,81 +30,116 @@ func newGRPCAction(grpcActionConfig *config.GRPCActionConfig, timeout time.Durat
 		return nil
 	}
 
+	// when a method is set, we call it instead of using the health service
+	var method *GRPCMethod = nil
+	if grpcActionConfig.Method != nil {
+		method = newGRPCMethod(grpcActionConfig.Method)
+		if method == nil {
+			logger.Error("could not process method for grpc probe config")
+			return nil
+		}
+	}
+
+	unixSocketPath, ok := newUnixSocketPath(grpcActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+
 	return &GRPCAction{
-		port:    grpcActionConfig.Port,
-		service: grpcActionConfig.Service,
-		timeout: timeout,
+		port:           grpcActionConfig.Port,
+		unixSocketPath: unixSocketPath,
+		service:        grpcActionConfig.Service,
+		method:         method,
+		timeout:        timeout,
 	}
 }
 
-func (action GRPCAction) act(probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) {
+func (action GRPCAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
 	logger.Debug("performing grpc probe")
-	// need to run this on a separate goroutine since the timeout could be greater than the period
-	go func() {
-		timeoutTime := time.Now().Add(action.timeout)
-		timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(context.Background(), timeoutTime, context.DeadlineExceeded)
-		defer timeoutContextCancelFunc()
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
 
-		// create the span
-		spanContext, span := (*tracer).Start(timeoutContext, "grpc-probe")
-		span.SetAttributes(attribute.KeyValue{
-			Key:   "bunny-probe-name",
-			Value: attribute.StringValue(probeName),
-		})
-		defer span.End()
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "grpc-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
 
-		// check the grpc server
-		var err error
-		var opts []grpc.CallOption = []grpc.CallOption{
-			grpc.WaitForReady(false),
-		}
-		timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
-		// create the grpc client and connect to the server
-		var target = net.JoinHostPort("localhost", fmt.Sprintf("%v", action.port))
-		conn, err := grpc.DialContext(spanContext, target,
-			grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
-			grpc.WithBlock(),
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
-				return newDialer().DialContext(ctx, "tcp", addr)
-			}),
-		)
-		if err != nil {
-			logger.Error("error while creating grpc client and connecting to server", "err", err)
-			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
-			return
-		}
-		defer conn.Close()
-		client := healthgrpc.NewHealthClient(conn)
-		// send the health check
-		var response *healthgrpc.HealthCheckResponse
-		if action.service == nil {
-			logger.Debug("no service set - asking about general rpc server health")
-			response, err = client.Check(spanContext, nil, opts...)
-		} else {
-			logger.Debug("service set - asking about health for service " + *action.service)
-			healthCheckRequest := healthgrpc.HealthCheckRequest{
-				Service: *action.service,
-			}
-			response, err = client.Check(spanContext, &healthCheckRequest, opts...)
-		}
-		message := ""
-		if err != nil {
-			message = "probe failed - could not check grpc server"
-		} else if response == nil {
-			message = "probe failed - response is nil"
-		} else if response.GetStatus() != healthgrpc.HealthCheckResponse_SERVING {
-			message = "probe failed - rpc server is not serving"
-		}
+	// check the grpc server
+	var err error
+	var opts []grpc.CallOption = []grpc.CallOption{
+		grpc.WaitForReady(false),
+	}
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	// create the grpc client and connect to the server
+	var target = net.JoinHostPort("localhost", fmt.Sprintf("%v", action.port))
+	var dialContext = newDialer().DialContext
+	if action.unixSocketPath != "" {
+		// the target is then only used as the authority for requests
+		target = "localhost"
+		dialContext = newUnixSocketDialContext(action.unixSocketPath)
+	}
+	conn, err := grpc.DialContext(spanContext, target,
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		logger.Error("error while creating grpc client and connecting to server", "err", err)
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		return false
+	}
+	defer conn.Close()
+	if action.method != nil {
+		message := action.method.invoke(spanContext, conn, &span)
 		if message != "" {
 			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
-			logger.Debug(message, "response.GetStatus()", response.GetStatus())
+			logger.Debug(message)
 			span.SetStatus(codes.Error, message)
-			return
+			return false
 		}
 		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
 		message = "probe succeeded"
 		logger.Debug(message)
 		span.SetStatus(codes.Ok, message)
-	}()
+		return true
+	}
+	client := healthgrpc.NewHealthClient(conn)
+	// send the health check
+	var response *healthgrpc.HealthCheckResponse
+	if action.service == nil {
+		logger.Debug("no service set - asking about general rpc server health")
+		response, err = client.Check(spanContext, nil, opts...)
+	} else {
+		logger.Debug("service set - asking about health for service " + *action.service)
+		healthCheckRequest := healthgrpc.HealthCheckRequest{
+			Service: *action.service,
+		}
+		response, err = client.Check(spanContext, &healthCheckRequest, opts...)
+	}
+	message := ""
+	if err != nil {
+		message = "probe failed - could not check grpc server"
+	} else if response == nil {
+		message = "probe failed - response is nil"
+	} else if response.GetStatus() != healthgrpc.HealthCheckResponse_SERVING {
+		message = "probe failed - rpc server is not serving"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "response.GetStatus()", response.GetStatus())
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
 }
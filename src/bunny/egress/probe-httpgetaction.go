@@ -42,7 +42,15 @@ func newHTTPGetAction(httpGetActionConfig *config.HTTPGetActionConfig, timeout t
 			return nil
 		}
 	}
+	unixSocketPath, ok := newUnixSocketPath(httpGetActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
 	var url string = fmt.Sprintf("%s://%s:%d/%s", scheme, host, httpGetActionConfig.Port, httpGetActionConfig.Path)
+	if unixSocketPath != "" && httpGetActionConfig.Port == 0 {
+		// the host is still used in the url (and so for the Host header) but the port is meaningless for a unix socket
+		url = fmt.Sprintf("%s://%s/%s", scheme, host, httpGetActionConfig.Path)
+	}
 	logger.Debug("built url", "url", url)
 
 	// create Transport
@@ -58,6 +66,9 @@ func newHTTPGetAction(httpGetActionConfig *config.HTTPGetActionConfig, timeout t
 		DisableCompression: true,
 		DialContext:        newDialer().DialContext,
 	}
+	if unixSocketPath != "" {
+		transport.DialContext = newUnixSocketDialContext(unixSocketPath)
+	}
 
 	// this seems like the correct timeout based on https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts
 	// (see the diagram in the "Client Timeouts" section)
@@ -81,52 +92,50 @@ func newHTTPGetAction(httpGetActionConfig *config.HTTPGetActionConfig, timeout t
 	}
 }
 
-func (action HTTPGetAction) act(probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) {
+func (action HTTPGetAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
 	logger.Debug("performing http probe")
-	// need to run this on a separate goroutine since the timeout could be greater than the period
-	go func() {
-		timeoutTime := time.Now().Add(action.timeout)
-		timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(context.Background(), timeoutTime, context.DeadlineExceeded)
-		defer timeoutContextCancelFunc()
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
 
-		// create the span
-		spanContext, span := (*tracer).Start(timeoutContext, "http-probe")
-		span.SetAttributes(attribute.KeyValue{
-			Key:   "bunny-probe-name",
-			Value: attribute.StringValue(probeName),
-		})
-		defer span.End()
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "http-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
 
-		// create the http request
-		// (we have to do it here instead of when creating the HTTPGetAction because we need the context for the span above)
-		var url = action.url
-		newHTTPProbeRequest, err := http.NewRequestWithContext(spanContext, http.MethodGet, url, nil)
-		if err != nil {
-			message := "probe failed - could not build request for http probe"
-			logger.Debug(message)
-			span.SetStatus(codes.Error, message)
-			return
-		}
-		newHTTPProbeRequest.Close = true // disable keep alives to force creation of new connections on each request
-		newHTTPProbeRequest.Header = action.headers
+	// create the http request
+	// (we have to do it here instead of when creating the HTTPGetAction because we need the context for the span above)
+	var url = action.url
+	newHTTPProbeRequest, err := http.NewRequestWithContext(spanContext, http.MethodGet, url, nil)
+	if err != nil {
+		message := "probe failed - could not build request for http probe"
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	newHTTPProbeRequest.Close = true // disable keep alives to force creation of new connections on each request
+	newHTTPProbeRequest.Header = action.headers
 
-		timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
-		response, err := action.client.Do(newHTTPProbeRequest)
-		if err != nil || response.StatusCode != http.StatusOK {
-			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
-			message := ""
-			if response == nil {
-				message = "probe failed - no response"
-			} else {
-				message = fmt.Sprintf("probe failed - http response not ok: %v", response.StatusCode)
-			}
-			logger.Debug(message)
-			span.SetStatus(codes.Error, message)
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	response, err := action.client.Do(newHTTPProbeRequest)
+	if err != nil || response.StatusCode != http.StatusOK {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		message := ""
+		if response == nil {
+			message = "probe failed - no response"
 		} else {
-			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
-			message := "probe succeeded"
-			logger.Debug(message)
-			span.SetStatus(codes.Ok, message)
+			message = fmt.Sprintf("probe failed - http response not ok: %v", response.StatusCode)
 		}
-	}()
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message := "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
 }
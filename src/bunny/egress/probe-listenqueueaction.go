@@ -0,0 +1,307 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ListenQueueAction struct {
+	port               int
+	maxQueueRatio      *float64
+	maxListenOverflows *uint64
+	maxListenDrops     *uint64
+	backlog            uint64
+	procNetPath        string
+	somaxconnPath      string
+	state              *ListenQueueState
+	timeout            time.Duration
+}
+
+// the counters from the last time that the probe ran, so that the deltas can be worked out
+type ListenQueueState struct {
+	mutex           sync.Mutex
+	sampled         bool
+	listenOverflows uint64
+	listenDrops     uint64
+}
+
+// what the sockets for the port look like
+type ListenQueueSockets struct {
+	listeners   int
+	queueLength uint64
+	established int
+}
+
+// containers in a pod share a network namespace, so Bunny sees the app's sockets here
+const defaultProcNetPath string = "/proc/net"
+
+// the most that a listening socket's backlog can be, which is also the backlog that Go (and many other runtimes) ask for
+const defaultSomaxconnPath string = "/proc/sys/net/core/somaxconn"
+
+// see: https://www.kernel.org/doc/Documentation/networking/proc_net_tcp.txt
+const tcpStateEstablished uint64 = 0x01
+const tcpStateListen uint64 = 0x0A
+
+func newListenQueueAction(listenQueueActionConfig *config.ListenQueueActionConfig, timeout time.Duration) *ListenQueueAction {
+	logger.Info("processing listen queue probe config")
+	if listenQueueActionConfig == nil {
+		return nil
+	}
+
+	if listenQueueActionConfig.Port <= 0 || listenQueueActionConfig.Port > 65535 {
+		logger.Error("port for listen queue action is not valid", "listenQueueActionConfig.Port", listenQueueActionConfig.Port)
+		return nil
+	}
+
+	var backlog uint64 = 0
+	if listenQueueActionConfig.Backlog != nil {
+		if *listenQueueActionConfig.Backlog == 0 {
+			logger.Error("backlog must be greater than 0 for listen queue action")
+			return nil
+		}
+		backlog = *listenQueueActionConfig.Backlog
+	}
+
+	return &ListenQueueAction{
+		port:               listenQueueActionConfig.Port,
+		maxQueueRatio:      listenQueueActionConfig.MaxQueueRatio,
+		maxListenOverflows: listenQueueActionConfig.MaxListenOverflows,
+		maxListenDrops:     listenQueueActionConfig.MaxListenDrops,
+		backlog:            backlog,
+		procNetPath:        defaultProcNetPath,
+		somaxconnPath:      defaultSomaxconnPath,
+		state:              &ListenQueueState{},
+		timeout:            timeout,
+	}
+}
+
+func (action ListenQueueAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing listen queue probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	_, span := (*tracer).Start(timeoutContext, "listen-queue-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.Int("server.port", action.port))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.check(probeName, &span)
+	if message == "" && time.Now().After(timeoutTime) {
+		message = "probe failed - timed out"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// reads the sockets and counters, records them in the local TSDB,
+// and then returns an empty message if the port passes all of the checks and a message explaining why if it doesn't
+func (action ListenQueueAction) check(probeName string, span *trace.Span) string {
+	// the state is shared by runs of the probe which overlap (when the timeout is longer than the period)
+	action.state.mutex.Lock()
+	defer action.state.mutex.Unlock()
+
+	now := time.Now()
+	var sockets ListenQueueSockets
+	for _, name := range []string{"tcp", "tcp6"} {
+		err := readProcNetTCP(filepath.Join(action.procNetPath, name), action.port, &sockets)
+		// there's no tcp6 when IPv6 is turned off
+		if err != nil && !(name == "tcp6" && errors.Is(err, os.ErrNotExist)) {
+			logger.Debug("could not read sockets", "name", name, "err", err)
+			return "probe failed - could not read sockets"
+		}
+	}
+	// /proc/net/tcp doesn't have the backlog of listening sockets, so it's either configured or assumed to be somaxconn
+	var backlog uint64 = action.backlog
+	if backlog == 0 {
+		somaxconn, err := readValueFile(action.somaxconnPath)
+		if err != nil {
+			logger.Debug("could not read somaxconn", "err", err)
+		} else {
+			backlog = uint64(somaxconn)
+		}
+	}
+	(*span).SetAttributes(
+		attribute.Int("bunny.listen_queue.listeners", sockets.listeners),
+		attribute.Int64("bunny.listen_queue.length", int64(sockets.queueLength)),
+		attribute.Int64("bunny.listen_queue.backlog", int64(backlog)),
+		attribute.Int("bunny.listen_queue.established", sockets.established),
+	)
+	var portLabels map[string]string = map[string]string{"probe": probeName, "port": strconv.Itoa(action.port)}
+	var samples []telemetry.Sample = []telemetry.Sample{
+		{Name: "bunny_listen_sockets", Labels: portLabels, Value: float64(sockets.listeners)},
+		{Name: "bunny_tcp_established_connections", Labels: portLabels, Value: float64(sockets.established)},
+	}
+	if sockets.listeners > 0 {
+		samples = append(samples, telemetry.Sample{Name: "bunny_listen_queue_length", Labels: portLabels, Value: float64(sockets.queueLength)})
+		// each listening socket (like with SO_REUSEPORT) has its own backlog
+		if backlog > 0 {
+			samples = append(samples, telemetry.Sample{Name: "bunny_listen_queue_backlog", Labels: portLabels, Value: float64(backlog * uint64(sockets.listeners))})
+		}
+	}
+
+	// these counters are for the whole network namespace rather than just the port
+	var overflowsDelta *uint64 = nil
+	var dropsDelta *uint64 = nil
+	tcpExt, err := readProcNetStat(filepath.Join(action.procNetPath, "netstat"), "TcpExt")
+	if err != nil {
+		logger.Debug("could not read netstat", "err", err)
+	} else {
+		var sampleLabels map[string]string = map[string]string{"probe": probeName}
+		overflows := tcpExt["ListenOverflows"]
+		drops := tcpExt["ListenDrops"]
+		samples = append(samples,
+			telemetry.Sample{Name: "bunny_tcp_listen_overflows_total", Labels: sampleLabels, Value: float64(overflows)},
+			telemetry.Sample{Name: "bunny_tcp_listen_drops_total", Labels: sampleLabels, Value: float64(drops)},
+		)
+		// the counters only go down if the network namespace is recreated
+		if action.state.sampled && overflows >= action.state.listenOverflows && drops >= action.state.listenDrops {
+			overflowsValue := overflows - action.state.listenOverflows
+			dropsValue := drops - action.state.listenDrops
+			overflowsDelta = &overflowsValue
+			dropsDelta = &dropsValue
+			samples = append(samples,
+				telemetry.Sample{Name: "bunny_tcp_listen_overflows_delta", Labels: sampleLabels, Value: float64(overflowsValue)},
+				telemetry.Sample{Name: "bunny_tcp_listen_drops_delta", Labels: sampleLabels, Value: float64(dropsValue)},
+			)
+			(*span).SetAttributes(
+				attribute.Int64("bunny.listen_queue.overflows_delta", int64(overflowsValue)),
+				attribute.Int64("bunny.listen_queue.drops_delta", int64(dropsValue)),
+			)
+		}
+		action.state.sampled = true
+		action.state.listenOverflows = overflows
+		action.state.listenDrops = drops
+	}
+	appendSamples(samples, now)
+
+	if sockets.listeners == 0 {
+		return fmt.Sprintf("probe failed - nothing listening on port %v", action.port)
+	}
+	if action.maxQueueRatio != nil {
+		if backlog == 0 {
+			return "probe failed - backlog is not known"
+		}
+		ratio := float64(sockets.queueLength) / float64(backlog*uint64(sockets.listeners))
+		if ratio > *action.maxQueueRatio {
+			return fmt.Sprintf("probe failed - accept queue is %.2f of backlog", ratio)
+		}
+	}
+	// the deltas aren't known on the first run, so they can't fail the probe until the second
+	if action.maxListenOverflows != nil && overflowsDelta != nil && *overflowsDelta > *action.maxListenOverflows {
+		return fmt.Sprintf("probe failed - %v listen overflows since the last run", *overflowsDelta)
+	}
+	if action.maxListenDrops != nil && dropsDelta != nil && *dropsDelta > *action.maxListenDrops {
+		return fmt.Sprintf("probe failed - %v listen drops since the last run", *dropsDelta)
+	}
+	return ""
+}
+
+// adds the sockets for the local port from /proc/net/tcp or /proc/net/tcp6
+// for listening sockets, rx_queue is the accept queue length
+func readProcNetTCP(path string, port int, sockets *ListenQueueSockets) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	// the first line is the header
+	for _, line := range lines[1:] {
+		// sl local_address rem_address st tx_queue:rx_queue ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		_, localPortHex, found := strings.Cut(fields[1], ":")
+		if !found {
+			return fmt.Errorf("bad local address in %v: %q", path, fields[1])
+		}
+		localPort, err := strconv.ParseUint(localPortHex, 16, 16)
+		if err != nil {
+			return err
+		}
+		if int(localPort) != port {
+			continue
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case tcpStateListen:
+			_, rxQueueHex, found := strings.Cut(fields[4], ":")
+			if !found {
+				return fmt.Errorf("bad queues in %v: %q", path, fields[4])
+			}
+			queueLength, err := strconv.ParseUint(rxQueueHex, 16, 64)
+			if err != nil {
+				return err
+			}
+			sockets.listeners++
+			sockets.queueLength += queueLength
+		case tcpStateEstablished:
+			sockets.established++
+		}
+	}
+	return nil
+}
+
+// /proc/net/netstat has pairs of lines for each group, the first with the names and the second with the values
+// like "TcpExt: SyncookiesSent ..." and then "TcpExt: 0 ..."
+func readProcNetStat(path string, group string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != group+":" {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		if len(fields[1:]) != len(names) {
+			return nil, fmt.Errorf("mismatched %v names and values in %v", group, path)
+		}
+		var values map[string]uint64 = map[string]uint64{}
+		for i, valueString := range fields[1:] {
+			value, err := strconv.ParseUint(valueString, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			values[names[i]] = value
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("no %v values in %v", group, path)
+}
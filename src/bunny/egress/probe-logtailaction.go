@@ -0,0 +1,376 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type LogTailAction struct {
+	path           string
+	fromStart      bool
+	readLimitBytes int
+	counters       []LogTailCounter
+	state          *LogTailState
+	timeout        time.Duration
+}
+
+// counts the lines that match regex, with a series for each set of values of its named capture groups
+type LogTailCounter struct {
+	name       string
+	regex      *regexp.Regexp
+	labelNames []string
+	maxSeries  int
+}
+
+// where the probe got to in the file, and the counts so far
+// the file is kept open between runs (like tail -F) so that lines written just before the file is rotated aren't lost
+// when the action is replaced by a config reload, the file is closed when it's garbage collected
+type LogTailState struct {
+	mutex   sync.Mutex
+	file    *os.File
+	opened  bool
+	offset  int64
+	partial []byte
+	// set when the line being read was already too long to count, so the rest of it is skipped
+	discarding bool
+	lines      uint64
+	// the series for each counter, keyed by their label values
+	series []map[string]*LogTailSeries
+}
+
+type LogTailSeries struct {
+	labels map[string]string
+	value  uint64
+}
+
+// how much of the file is read each time the probe runs unless readLimitBytes is set
+// anything more is read the next time
+const defaultLogTailReadLimitBytes int = 10 * 1024 * 1024
+
+// lines longer than this are skipped
+const logTailMaxLineBytes int = 64 * 1024
+
+const defaultLogTailMaxSeries int = 100
+
+var metricNameRegEx *regexp.Regexp = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+func newLogTailAction(logTailActionConfig *config.LogTailActionConfig, timeout time.Duration) *LogTailAction {
+	logger.Info("processing log tail probe config")
+	if logTailActionConfig == nil {
+		return nil
+	}
+
+	if logTailActionConfig.Path == "" {
+		logger.Error("path must be set for log tail action")
+		return nil
+	}
+	var readLimitBytes int = defaultLogTailReadLimitBytes
+	if logTailActionConfig.ReadLimitBytes != nil {
+		if *logTailActionConfig.ReadLimitBytes <= 0 {
+			logger.Error("readLimitBytes must be greater than 0 for log tail action", "logTailActionConfig.ReadLimitBytes", *logTailActionConfig.ReadLimitBytes)
+			return nil
+		}
+		readLimitBytes = *logTailActionConfig.ReadLimitBytes
+	}
+
+	var counters []LogTailCounter = []LogTailCounter{}
+	var series []map[string]*LogTailSeries = []map[string]*LogTailSeries{}
+	for _, counterConfig := range logTailActionConfig.Counters {
+		counter := newLogTailCounter(&counterConfig)
+		if counter == nil {
+			logger.Error("could not process counters for log tail probe config")
+			return nil
+		}
+		counters = append(counters, *counter)
+		series = append(series, map[string]*LogTailSeries{})
+	}
+
+	return &LogTailAction{
+		path:           logTailActionConfig.Path,
+		fromStart:      logTailActionConfig.FromStart,
+		readLimitBytes: readLimitBytes,
+		counters:       counters,
+		state:          &LogTailState{series: series},
+		timeout:        timeout,
+	}
+}
+
+func newLogTailCounter(counterConfig *config.LogTailCounterConfig) *LogTailCounter {
+	if !metricNameRegEx.MatchString(counterConfig.Name) {
+		logger.Error("name for log tail counter is not a valid metric name", "counterConfig.Name", counterConfig.Name)
+		return nil
+	}
+	regex, err := regexp.Compile(counterConfig.RegEx)
+	if err != nil {
+		logger.Error("error in regex for log tail counter", "counterConfig.RegEx", counterConfig.RegEx, "err", err)
+		return nil
+	}
+	// named capture groups become labels
+	var labelNames []string = []string{}
+	for _, labelName := range regex.SubexpNames() {
+		if labelName == "" {
+			continue
+		}
+		if labelName == "probe" || strings.HasPrefix(labelName, "__") {
+			logger.Error("capture group name for log tail counter is reserved", "labelName", labelName)
+			return nil
+		}
+		labelNames = append(labelNames, labelName)
+	}
+	var maxSeries int = defaultLogTailMaxSeries
+	if counterConfig.MaxSeries != nil {
+		if *counterConfig.MaxSeries <= 0 {
+			logger.Error("maxSeries must be greater than 0 for log tail counter", "counterConfig.MaxSeries", *counterConfig.MaxSeries)
+			return nil
+		}
+		maxSeries = *counterConfig.MaxSeries
+	}
+	return &LogTailCounter{
+		name:       counterConfig.Name,
+		regex:      regex,
+		labelNames: labelNames,
+		maxSeries:  maxSeries,
+	}
+}
+
+func (action LogTailAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing log tail probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	_, span := (*tracer).Start(timeoutContext, "log-tail-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("file.path", action.path))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.check(probeName, &span)
+	if message == "" && time.Now().After(timeoutTime) {
+		message = "probe failed - timed out"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// reads the lines added since the last run, counts them, and appends the counts to the local TSDB
+// returns an empty message if the file could be read and a message explaining why if it couldn't
+func (action LogTailAction) check(probeName string, span *trace.Span) string {
+	// the state is shared by runs of the probe which overlap (when the timeout is longer than the period)
+	state := action.state
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.file == nil {
+		err := action.open(state, !action.fromStart && !state.opened)
+		if err != nil {
+			logger.Debug("could not open file", "path", action.path, "err", err)
+			return "probe failed - could not open file"
+		}
+	}
+
+	// copytruncate style rotation (or the app truncating its own log) leaves the file smaller than where we got to
+	fileInfo, err := state.file.Stat()
+	if err != nil {
+		logger.Debug("could not stat file", "path", action.path, "err", err)
+		return "probe failed - could not stat file"
+	}
+	if fileInfo.Size() < state.offset {
+		logger.Debug("file was truncated", "path", action.path)
+		(*span).AddEvent("truncated")
+		_, err = state.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return "probe failed - could not seek to start of truncated file"
+		}
+		state.offset = 0
+		state.partial = nil
+		state.discarding = false
+	}
+
+	bytesRead, err := action.read(state, action.readLimitBytes)
+	if err != nil {
+		logger.Debug("could not read file", "path", action.path, "err", err)
+		return "probe failed - could not read file"
+	}
+
+	// once the old file has been read to the end, move on to the file that's replaced it (from its start)
+	// if nothing has replaced it yet, we keep following the old file
+	pathInfo, err := os.Stat(action.path)
+	if err == nil && !os.SameFile(pathInfo, fileInfo) && bytesRead < action.readLimitBytes {
+		logger.Debug("file was rotated", "path", action.path)
+		(*span).AddEvent("rotated")
+		state.file.Close()
+		state.file = nil
+		err = action.open(state, false)
+		if err != nil {
+			logger.Debug("could not open rotated file", "path", action.path, "err", err)
+			return "probe failed - could not open file"
+		}
+		moreBytesRead, err := action.read(state, action.readLimitBytes-bytesRead)
+		bytesRead += moreBytesRead
+		if err != nil {
+			logger.Debug("could not read rotated file", "path", action.path, "err", err)
+			return "probe failed - could not read file"
+		}
+	}
+	(*span).SetAttributes(attribute.Int("bunny.log_tail.bytes_read", bytesRead))
+
+	now := time.Now()
+	var samples []telemetry.Sample = []telemetry.Sample{
+		{Name: "bunny_log_tail_lines_total", Labels: map[string]string{"probe": probeName}, Value: float64(state.lines)},
+	}
+	for i, counter := range action.counters {
+		for _, series := range state.series[i] {
+			var labels map[string]string = map[string]string{"probe": probeName}
+			for name, value := range series.labels {
+				labels[name] = value
+			}
+			samples = append(samples, telemetry.Sample{Name: counter.name, Labels: labels, Value: float64(series.value)})
+		}
+	}
+	appendSamples(samples, now)
+	return ""
+}
+
+// opens the file, either at its end (so that lines from before Bunny started aren't counted) or its start
+func (action LogTailAction) open(state *LogTailState, atEnd bool) error {
+	file, err := os.Open(action.path)
+	if err != nil {
+		return err
+	}
+	var offset int64 = 0
+	if atEnd {
+		offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	state.file = file
+	state.opened = true
+	state.offset = offset
+	state.partial = nil
+	state.discarding = false
+	// counters without any labels always have a series, so that rate() works before the first match
+	for i, counter := range action.counters {
+		if len(counter.labelNames) == 0 && state.series[i][""] == nil {
+			state.series[i][""] = &LogTailSeries{labels: map[string]string{}}
+		}
+	}
+	return nil
+}
+
+// reads up to limit bytes (or to the end of the file) and counts the complete lines
+func (action LogTailAction) read(state *LogTailState, limit int) (int, error) {
+	buffer := make([]byte, 64*1024)
+	var bytesRead int = 0
+	for bytesRead < limit {
+		n, err := state.file.Read(buffer[:min(len(buffer), limit-bytesRead)])
+		if n > 0 {
+			bytesRead += n
+			state.offset += int64(n)
+			action.countLines(state, buffer[:n])
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return bytesRead, err
+		}
+	}
+	return bytesRead, nil
+}
+
+func (action LogTailAction) countLines(state *LogTailState, data []byte) {
+	if state.discarding {
+		index := bytes.IndexByte(data, '\n')
+		if index < 0 {
+			return
+		}
+		data = data[index+1:]
+		state.discarding = false
+	}
+	data = append(state.partial, data...)
+	for {
+		index := bytes.IndexByte(data, '\n')
+		if index < 0 {
+			break
+		}
+		line := data[:index]
+		data = data[index+1:]
+		if len(line) > logTailMaxLineBytes {
+			continue
+		}
+		action.countLine(state, string(bytes.TrimSuffix(line, []byte("\r"))))
+	}
+	// keep the start of a line that hasn't been finished yet, unless it's already too long to count
+	if len(data) > logTailMaxLineBytes {
+		data = nil
+		state.discarding = true
+	}
+	state.partial = bytes.Clone(data)
+}
+
+func (action LogTailAction) countLine(state *LogTailState, line string) {
+	state.lines++
+	for i, counter := range action.counters {
+		match := counter.regex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		var labels map[string]string = map[string]string{}
+		for j, name := range counter.regex.SubexpNames() {
+			if name != "" {
+				labels[name] = match[j]
+			}
+		}
+		key := logTailSeriesKey(labels)
+		series, found := state.series[i][key]
+		if !found {
+			// stop a capture group that matches something like a request id from creating endless series
+			if len(state.series[i]) >= counter.maxSeries {
+				logger.Debug("too many series for log tail counter", "counter.name", counter.name, "labels", labels)
+				continue
+			}
+			series = &LogTailSeries{labels: labels}
+			state.series[i][key] = series
+		}
+		series.value++
+	}
+}
+
+func logTailSeriesKey(labels map[string]string) string {
+	var pairs []string = []string{}
+	for name, value := range labels {
+		pairs = append(pairs, name+"\x00"+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
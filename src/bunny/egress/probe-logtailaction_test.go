@@ -0,0 +1,35 @@
+package egress
+
+import (
+	"bunny/config"
+	"bytes"
+	"testing"
+)
+
+func TestLogTailCountLines(t *testing.T) {
+	action := newLogTailAction(&config.LogTailActionConfig{
+		Path:     "/var/log/app.log",
+		Counters: []config.LogTailCounterConfig{{Name: "app_errors_total", RegEx: "ERROR"}},
+	}, 0)
+	if action == nil {
+		t.Fatal("could not create log tail action")
+	}
+	state := action.state
+	state.series[0][""] = &LogTailSeries{labels: map[string]string{}}
+
+	// a line that's too long, in chunks like the file is read in, with ERROR at the end of it
+	long := bytes.Repeat([]byte("x"), logTailMaxLineBytes)
+	action.countLines(state, []byte("ERROR first\nstart of a long line "))
+	action.countLines(state, long)
+	action.countLines(state, long)
+	action.countLines(state, []byte("ERROR at the end of the long line\nERROR last\r\npartial"))
+	if state.lines != 2 {
+		t.Errorf("expected 2 lines but there were %v", state.lines)
+	}
+	if value := state.series[0][""].value; value != 2 {
+		t.Errorf("expected 2 errors but there were %v", value)
+	}
+	if string(state.partial) != "partial" || state.discarding {
+		t.Errorf("expected the partial line to be kept but it was %q (discarding %v)", state.partial, state.discarding)
+	}
+}
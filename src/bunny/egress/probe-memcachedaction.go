@@ -0,0 +1,170 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+type MemcachedAction struct {
+	server          *Server
+	versionRegex    *regexp.Regexp
+	statsAssertions []FieldAssertion
+	timeout         time.Duration
+}
+
+const defaultMemcachedPort int = 11211
+
+// stats replies are a few KiB, so anything much bigger than that isn't a memcached server
+const memcachedStatsLimitLines int = 1000
+
+func newMemcachedAction(memcachedActionConfig *config.MemcachedActionConfig, timeout time.Duration) *MemcachedAction {
+	logger.Info("processing memcached probe config")
+	if memcachedActionConfig == nil {
+		return nil
+	}
+
+	server := newServer(&memcachedActionConfig.ServerConfig, defaultMemcachedPort)
+	if server == nil {
+		logger.Error("could not process server for memcached probe config")
+		return nil
+	}
+
+	var versionRegex *regexp.Regexp = nil
+	if memcachedActionConfig.Version != nil {
+		var err error
+		versionRegex, err = regexp.Compile(*memcachedActionConfig.Version)
+		if err != nil {
+			logger.Error("error in version regex for memcached action", "memcachedActionConfig.Version", *memcachedActionConfig.Version, "err", err)
+			return nil
+		}
+	}
+
+	statsAssertions, ok := newFieldAssertions(memcachedActionConfig.Stats)
+	if !ok {
+		return nil
+	}
+
+	return &MemcachedAction{
+		server:          server,
+		versionRegex:    versionRegex,
+		statsAssertions: statsAssertions,
+		timeout:         timeout,
+	}
+}
+
+func (action MemcachedAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing memcached probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "memcached-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("db.system", "memcached"))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	connection, err := action.server.connect(spanContext, timeoutTime, &span)
+	if err != nil {
+		message := "probe failed - could not connect to memcached server"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer connection.Close()
+
+	readWriter := bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection))
+	message := action.check(readWriter)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// returns an empty message if the server passes all of the checks and a message explaining why if it doesn't
+func (action MemcachedAction) check(readWriter *bufio.ReadWriter) string {
+	// see: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+	reply, err := memcachedCommand(readWriter, "version")
+	if err != nil || !strings.HasPrefix(reply, "VERSION ") {
+		logger.Debug("memcached version failed", "reply", reply, "err", err)
+		return "probe failed - memcached version failed"
+	}
+	version := strings.TrimPrefix(reply, "VERSION ")
+	if action.versionRegex != nil && !action.versionRegex.MatchString(version) {
+		return fmt.Sprintf("probe failed - memcached version did not match regex: %v", version)
+	}
+
+	if len(action.statsAssertions) == 0 {
+		return ""
+	}
+	stats, err := memcachedStats(readWriter)
+	if err != nil {
+		logger.Debug("memcached stats failed", "err", err)
+		return "probe failed - memcached stats failed"
+	}
+	return checkFieldAssertions(action.statsAssertions, stats)
+}
+
+// sends a command and returns the first line of the reply
+func memcachedCommand(readWriter *bufio.ReadWriter, command string) (string, error) {
+	_, err := readWriter.WriteString(command + "\r\n")
+	if err == nil {
+		err = readWriter.Flush()
+	}
+	if err != nil {
+		return "", err
+	}
+	return readMemcachedLine(readWriter)
+}
+
+func readMemcachedLine(readWriter *bufio.ReadWriter) (string, error) {
+	line, err := readWriter.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", errors.New(line)
+	}
+	return line, nil
+}
+
+// stats replies are "STAT name value" lines followed by "END"
+func memcachedStats(readWriter *bufio.ReadWriter) (map[string]string, error) {
+	var stats map[string]string = map[string]string{}
+	line, err := memcachedCommand(readWriter, "stats")
+	for i := 0; err == nil && line != "END"; i++ {
+		if i >= memcachedStatsLimitLines {
+			return nil, errors.New("too many lines in memcached stats")
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			return nil, fmt.Errorf("unexpected line in memcached stats: %q", line)
+		}
+		stats[fields[1]] = fields[2]
+		line, err = readMemcachedLine(readWriter)
+	}
+	return stats, err
+}
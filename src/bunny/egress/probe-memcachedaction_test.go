@@ -0,0 +1,66 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a memcached server that knows version and stats
+func fakeMemcachedServer(connection net.Conn) {
+	reader := bufio.NewReader(connection)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var reply string
+		switch strings.TrimSpace(line) {
+		case "version":
+			reply = "VERSION 1.6.21\r\n"
+		case "stats":
+			reply = "STAT pid 1\r\nSTAT curr_connections 2\r\nSTAT accepting_conns 1\r\nEND\r\n"
+		default:
+			reply = "ERROR\r\n"
+		}
+		connection.Write([]byte(reply))
+	}
+}
+
+func TestMemcachedAction(t *testing.T) {
+	port := startFakeServer(t, fakeMemcachedServer)
+	tests := []struct {
+		name    string
+		version *string
+		stats   []config.FieldAssertionConfig
+		success bool
+	}{
+		{name: "version", success: true},
+		{name: "version matches", version: stringPointer(`^1\.6\.`), success: true},
+		{name: "stats match", stats: []config.FieldAssertionConfig{{Name: "accepting_conns", RegEx: "^1$"}, {Name: "curr_connections", RegEx: `^\d+$`}}, success: true},
+		{name: "version does not match", version: stringPointer(`^1\.4\.`), success: false},
+		{name: "stats do not match", stats: []config.FieldAssertionConfig{{Name: "accepting_conns", RegEx: "^0$"}}, success: false},
+		{name: "stat missing", stats: []config.FieldAssertionConfig{{Name: "evictions", RegEx: "^0$"}}, success: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memcachedActionConfig := config.MemcachedActionConfig{
+				ServerConfig: config.ServerConfig{Host: stringPointer("127.0.0.1"), Port: &port},
+				Version:      test.version,
+				Stats:        test.stats,
+			}
+			action := newMemcachedAction(&memcachedActionConfig, time.Second)
+			if action == nil {
+				t.Fatal("could not create memcached action")
+			}
+			success := action.act(context.Background(), test.name, nil, nil, nil)
+			if success != test.success {
+				t.Errorf("expected success to be %v but it was %v", test.success, success)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/common"
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type PostgresAction struct {
+	server   *Server
+	user     string
+	database string
+	password *config.SecretConfig
+	query    string
+	regex    *regexp.Regexp
+	timeout  time.Duration
+}
+
+const defaultPostgresPort int = 5432
+
+// the largest message from the server that we'll read
+const postgresMessageLimitBytes int = 1024 * 1024
+
+// see: https://www.postgresql.org/docs/current/protocol-message-formats.html
+const postgresProtocolVersion uint32 = 196608 // 3.0
+const postgresSSLRequestCode uint32 = 80877103
+
+const postgresAuthenticationOk uint32 = 0
+const postgresAuthenticationCleartextPassword uint32 = 3
+const postgresAuthenticationMD5Password uint32 = 5
+const postgresAuthenticationSASL uint32 = 10
+const postgresAuthenticationSASLContinue uint32 = 11
+const postgresAuthenticationSASLFinal uint32 = 12
+
+// the iteration count comes from the server and pbkdf2 can't be cancelled, so a huge one would keep a core busy
+// long after the probe has timed out (postgres uses 4096 by default)
+const postgresMaxSCRAMIterations int = 1 << 20
+
+func newPostgresAction(postgresActionConfig *config.PostgresActionConfig, timeout time.Duration) *PostgresAction {
+	logger.Info("processing postgres probe config")
+	if postgresActionConfig == nil {
+		return nil
+	}
+
+	server := newServer(&postgresActionConfig.ServerConfig, defaultPostgresPort)
+	if server == nil {
+		logger.Error("could not process server for postgres probe config")
+		return nil
+	}
+	if postgresActionConfig.User == "" {
+		logger.Error("user must be set for postgres action")
+		return nil
+	}
+
+	// like psql, the database defaults to the user's name
+	var database string = postgresActionConfig.User
+	if postgresActionConfig.Database != nil && *postgresActionConfig.Database != "" {
+		database = *postgresActionConfig.Database
+	}
+
+	var query string = ""
+	if postgresActionConfig.Query != nil {
+		query = *postgresActionConfig.Query
+	}
+	var regex *regexp.Regexp = nil
+	if postgresActionConfig.RegEx != nil {
+		if query == "" {
+			logger.Error("regex for postgres action needs a query")
+			return nil
+		}
+		var err error
+		regex, err = regexp.Compile(*postgresActionConfig.RegEx)
+		if err != nil {
+			logger.Error("error in regex for postgres action", "postgresActionConfig.RegEx", *postgresActionConfig.RegEx, "err", err)
+			return nil
+		}
+	}
+
+	return &PostgresAction{
+		server:   server,
+		user:     postgresActionConfig.User,
+		database: database,
+		password: postgresActionConfig.Password,
+		query:    query,
+		regex:    regex,
+		timeout:  timeout,
+	}
+}
+
+func (action PostgresAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing postgres probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "postgres-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.user", action.user),
+		attribute.String("db.name", action.database),
+	)
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	// postgres connections start without TLS and are upgraded if the server agrees to it
+	connection, err := action.server.dial(spanContext, timeoutTime, &span)
+	if err != nil {
+		message := "probe failed - could not connect to postgres server"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer connection.Close()
+
+	message := action.check(spanContext, connection, &span)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// returns an empty message if the server passes all of the checks and a message explaining why if it doesn't
+func (action PostgresAction) check(ctx context.Context, connection net.Conn, span *trace.Span) string {
+	if action.server.tlsConfig != nil {
+		tlsConnection, err := action.startTLS(ctx, connection, span)
+		if err != nil {
+			logger.Debug("postgres tls failed", "err", err)
+			return "probe failed - could not start tls with postgres server"
+		}
+		defer tlsConnection.Close()
+		connection = tlsConnection
+	}
+	client := PostgresClient{readWriter: bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection))}
+
+	err := action.startup(&client)
+	if err != nil {
+		logger.Debug("postgres startup failed", "err", err)
+		return "probe failed - postgres startup failed"
+	}
+
+	if action.query != "" {
+		(*span).SetAttributes(attribute.String("db.statement", action.query))
+		value, err := client.simpleQuery(action.query)
+		if err != nil {
+			logger.Debug("postgres query failed", "err", err)
+			return "probe failed - postgres query failed"
+		}
+		if action.regex != nil && !action.regex.MatchString(value) {
+			logger.Debug("postgres query result did not match regex", "value", value)
+			return "probe failed - postgres query result did not match regex"
+		}
+	}
+
+	// be polite and say goodbye
+	client.send('X', nil)
+	return ""
+}
+
+func (action PostgresAction) startTLS(ctx context.Context, connection net.Conn, span *trace.Span) (net.Conn, error) {
+	request := binary.BigEndian.AppendUint32(nil, 8)
+	request = binary.BigEndian.AppendUint32(request, postgresSSLRequestCode)
+	_, err := connection.Write(request)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1)
+	_, err = io.ReadFull(connection, response)
+	if err != nil {
+		return nil, err
+	}
+	if response[0] != 'S' {
+		return nil, errors.New("postgres server does not support tls")
+	}
+	return action.server.handshake(ctx, connection, span)
+}
+
+func (action PostgresAction) startup(client *PostgresClient) error {
+	startup := binary.BigEndian.AppendUint32(nil, postgresProtocolVersion)
+	for _, parameter := range []string{"user", action.user, "database", action.database, "application_name", "bunny"} {
+		startup = append(startup, parameter...)
+		startup = append(startup, 0)
+	}
+	startup = append(startup, 0)
+	// the startup message is the only one without a type
+	err := client.send(0, startup)
+	if err != nil {
+		return err
+	}
+
+	var scram *PostgresSCRAM = nil
+	for {
+		messageType, payload, err := client.receive()
+		if err != nil {
+			return err
+		}
+		switch messageType {
+		case 'R':
+			if len(payload) < 4 {
+				return errors.New("short authentication message from postgres server")
+			}
+			scram, err = action.authenticate(client, binary.BigEndian.Uint32(payload), payload[4:], scram)
+			if err != nil {
+				return err
+			}
+		case 'Z':
+			// the server is ready for queries
+			return nil
+		case 'E':
+			return postgresError(payload)
+		}
+		// anything else (like ParameterStatus and BackendKeyData) isn't needed
+	}
+}
+
+// once a SCRAM exchange has started, the server has to finish it by proving that it knows the password
+// rather than asking for the password itself or saying that we're authenticated
+func (action PostgresAction) authenticate(client *PostgresClient, code uint32, data []byte, scram *PostgresSCRAM) (*PostgresSCRAM, error) {
+	if code == postgresAuthenticationOk {
+		if scram != nil && !scram.verified {
+			return nil, errors.New("postgres server did not prove that it knows the password before authenticating")
+		}
+		return scram, nil
+	}
+	if scram != nil && code != postgresAuthenticationSASLContinue && code != postgresAuthenticationSASLFinal {
+		return nil, fmt.Errorf("unexpected authentication method from postgres server during SCRAM: %v", code)
+	}
+	password, err := common.ReadSecret(action.password)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case postgresAuthenticationCleartextPassword:
+		return nil, client.send('p', append([]byte(password), 0))
+	case postgresAuthenticationMD5Password:
+		if len(data) < 4 {
+			return nil, errors.New("short md5 salt from postgres server")
+		}
+		inner := md5.Sum([]byte(password + action.user))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+		return nil, client.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+	case postgresAuthenticationSASL:
+		if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+			return nil, errors.New("postgres server does not support SCRAM-SHA-256")
+		}
+		scram, err = newPostgresSCRAM(password)
+		if err != nil {
+			return nil, err
+		}
+		clientFirst := scram.clientFirst()
+		message := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(clientFirst)))...)
+		return scram, client.send('p', append(message, clientFirst...))
+	case postgresAuthenticationSASLContinue:
+		if scram == nil {
+			return nil, errors.New("unexpected SASL continue from postgres server")
+		}
+		clientFinal, err := scram.clientFinal(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return scram, client.send('p', []byte(clientFinal))
+	case postgresAuthenticationSASLFinal:
+		if scram == nil || scram.serverSignature == nil {
+			return nil, errors.New("unexpected SASL final from postgres server")
+		}
+		return scram, scram.verifyServerFinal(string(data))
+	}
+	return nil, fmt.Errorf("unsupported postgres authentication method: %v", code)
+}
+
+// the messages of the postgres protocol are a type byte and then the length (including itself) as 4 bytes
+type PostgresClient struct {
+	readWriter *bufio.ReadWriter
+}
+
+func (client *PostgresClient) send(messageType byte, payload []byte) error {
+	var message []byte = []byte{}
+	if messageType != 0 {
+		message = append(message, messageType)
+	}
+	message = binary.BigEndian.AppendUint32(message, uint32(len(payload)+4))
+	message = append(message, payload...)
+	_, err := client.readWriter.Write(message)
+	if err != nil {
+		return err
+	}
+	return client.readWriter.Flush()
+}
+
+func (client *PostgresClient) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(client.readWriter, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length-4 > postgresMessageLimitBytes {
+		return 0, nil, fmt.Errorf("bad length for postgres message: %v", length)
+	}
+	payload := make([]byte, length-4)
+	_, err = io.ReadFull(client.readWriter, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// runs the query and returns the first column of the first row (or an empty string if there are no rows)
+func (client *PostgresClient) simpleQuery(query string) (string, error) {
+	err := client.send('Q', append([]byte(query), 0))
+	if err != nil {
+		return "", err
+	}
+	var value string = ""
+	var gotRow bool = false
+	var queryErr error = nil
+	for {
+		messageType, payload, err := client.receive()
+		if err != nil {
+			return "", err
+		}
+		switch messageType {
+		case 'D':
+			if !gotRow {
+				gotRow = true
+				value, err = postgresFirstColumn(payload)
+				if err != nil {
+					return "", err
+				}
+			}
+		case 'E':
+			// the server still sends ReadyForQuery after an error
+			queryErr = postgresError(payload)
+		case 'Z':
+			return value, queryErr
+		}
+	}
+}
+
+func postgresFirstColumn(dataRow []byte) (string, error) {
+	if len(dataRow) < 2 || binary.BigEndian.Uint16(dataRow) == 0 {
+		return "", nil
+	}
+	if len(dataRow) < 6 {
+		return "", errors.New("short data row from postgres server")
+	}
+	length := int32(binary.BigEndian.Uint32(dataRow[2:]))
+	// null
+	if length < 0 {
+		return "", nil
+	}
+	if int(length) > len(dataRow)-6 {
+		return "", errors.New("bad column length from postgres server")
+	}
+	return string(dataRow[6 : 6+length]), nil
+}
+
+// error responses are a list of fields, each a type byte and a null terminated string
+func postgresError(payload []byte) error {
+	var fields map[byte]string = map[byte]string{}
+	for len(payload) > 1 {
+		fieldType := payload[0]
+		value, rest, found := strings.Cut(string(payload[1:]), "\x00")
+		if !found {
+			break
+		}
+		fields[fieldType] = value
+		payload = []byte(rest)
+	}
+	return fmt.Errorf("postgres error %v: %v", fields['C'], fields['M'])
+}
+
+// SCRAM-SHA-256 authentication, as used by postgres by default since version 14
+// see: https://www.postgresql.org/docs/current/sasl-authentication.html and RFC 5802
+type PostgresSCRAM struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+func newPostgresSCRAM(password string) (*PostgresSCRAM, error) {
+	nonceBytes := make([]byte, 18)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return nil, err
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(nonceBytes)
+	return &PostgresSCRAM{
+		password:    password,
+		clientNonce: clientNonce,
+		// postgres ignores the user name here in favour of the one in the startup message
+		clientFirstBare: "n=,r=" + clientNonce,
+	}, nil
+}
+
+func (scram *PostgresSCRAM) clientFirst() string {
+	return "n,," + scram.clientFirstBare
+}
+
+func (scram *PostgresSCRAM) clientFinal(serverFirst string) (string, error) {
+	attributes := parseSCRAMAttributes(serverFirst)
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, scram.clientNonce) {
+		return "", errors.New("bad nonce from postgres server")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return "", err
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 || iterations > postgresMaxSCRAMIterations {
+		return "", fmt.Errorf("bad iteration count from postgres server: %v", attributes["i"])
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(scram.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := scram.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	scram.serverSignature = scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// checking the server's signature means that we know the server knows the password too
+func (scram *PostgresSCRAM) verifyServerFinal(serverFinal string) error {
+	serverSignature, err := base64.StdEncoding.DecodeString(parseSCRAMAttributes(serverFinal)["v"])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(serverSignature, scram.serverSignature) {
+		return errors.New("bad server signature from postgres server")
+	}
+	scram.verified = true
+	return nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func parseSCRAMAttributes(message string) map[string]string {
+	var attributes map[string]string = map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		name, value, found := strings.Cut(attribute, "=")
+		if found {
+			attributes[name] = value
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,243 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// how the fake postgres server authenticates
+// the scram methods other than "scram" misbehave in ways that the client has to catch
+const (
+	fakePostgresCleartext        = "cleartext"
+	fakePostgresMD5              = "md5"
+	fakePostgresSCRAM            = "scram"
+	fakePostgresSCRAMNoFinal     = "scram without final"
+	fakePostgresSCRAMBadFinal    = "scram with bad final"
+	fakePostgresSCRAMToCleartext = "scram then cleartext"
+	fakePostgresSCRAMIterations  = "scram with too many iterations"
+)
+
+// a postgres server with one user which authenticates with method,
+// and which answers "SELECT 1" (and fails any other query)
+func fakePostgresServer(user string, password string, method string) func(connection net.Conn) {
+	return func(connection net.Conn) {
+		reader := bufio.NewReader(connection)
+		send := func(messageType byte, payload []byte) {
+			message := binary.BigEndian.AppendUint32([]byte{messageType}, uint32(len(payload)+4))
+			connection.Write(append(message, payload...))
+		}
+		sendError := func(code string, message string) {
+			send('E', []byte("SERROR\x00C"+code+"\x00M"+message+"\x00\x00"))
+		}
+
+		// the startup message has no type, just the length and then the protocol version and parameters
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+		if _, err := io.ReadFull(reader, startup); err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(startup) != postgresProtocolVersion {
+			sendError("08P01", "unsupported protocol version")
+			return
+		}
+		var parameters map[string]string = map[string]string{}
+		fields := strings.Split(string(startup[4:]), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			parameters[fields[i]] = fields[i+1]
+		}
+		if parameters["user"] != user {
+			sendError("28000", "role does not exist")
+			return
+		}
+
+		switch method {
+		case fakePostgresCleartext, fakePostgresMD5:
+			salt := []byte{1, 2, 3, 4}
+			expected := password
+			if method == fakePostgresMD5 {
+				send('R', append(binary.BigEndian.AppendUint32(nil, postgresAuthenticationMD5Password), salt...))
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+				expected = "md5" + hex.EncodeToString(outer[:])
+			} else {
+				send('R', binary.BigEndian.AppendUint32(nil, postgresAuthenticationCleartextPassword))
+			}
+			messageType, payload, err := readPostgresMessage(reader)
+			if err != nil || messageType != 'p' || strings.TrimSuffix(string(payload), "\x00") != expected {
+				sendError("28P01", "password authentication failed")
+				return
+			}
+		default:
+			if !fakePostgresSCRAMExchange(reader, send, password, method) {
+				sendError("28P01", "password authentication failed")
+				return
+			}
+		}
+		send('R', binary.BigEndian.AppendUint32(nil, postgresAuthenticationOk))
+		send('S', []byte("server_version\x0016.2\x00"))
+		send('Z', []byte("I"))
+
+		for {
+			messageType, payload, err := readPostgresMessage(reader)
+			if err != nil || messageType == 'X' {
+				return
+			}
+			if messageType != 'Q' {
+				continue
+			}
+			if strings.TrimSuffix(string(payload), "\x00") == "SELECT 1" {
+				// the client doesn't look at the row description, so it's left empty
+				send('T', []byte{0, 0})
+				row := binary.BigEndian.AppendUint16(nil, 1)
+				row = binary.BigEndian.AppendUint32(row, 1)
+				send('D', append(row, '1'))
+				send('C', []byte("SELECT 1\x00"))
+			} else {
+				sendError("42601", "syntax error")
+			}
+			send('Z', []byte("I"))
+		}
+	}
+}
+
+// the server side of SCRAM-SHA-256, returning whether the client proved that it knows the password
+func fakePostgresSCRAMExchange(reader *bufio.Reader, send func(byte, []byte), password string, method string) bool {
+	send('R', append(binary.BigEndian.AppendUint32(nil, postgresAuthenticationSASL), "SCRAM-SHA-256\x00\x00"...))
+	messageType, payload, err := readPostgresMessage(reader)
+	if err != nil || messageType != 'p' {
+		return false
+	}
+	// the mechanism, then the length of the client first message and the message itself
+	_, rest, _ := strings.Cut(string(payload), "\x00")
+	if len(rest) < 4 {
+		return false
+	}
+	clientFirstBare := strings.TrimPrefix(rest[4:], "n,,")
+	if method == fakePostgresSCRAMToCleartext {
+		send('R', binary.BigEndian.AppendUint32(nil, postgresAuthenticationCleartextPassword))
+		_, payload, err = readPostgresMessage(reader)
+		// the client shouldn't have sent the password
+		return err == nil && strings.TrimSuffix(string(payload), "\x00") == password
+	}
+
+	iterations := 4096
+	if method == fakePostgresSCRAMIterations {
+		iterations = postgresMaxSCRAMIterations + 1
+	}
+	salt := []byte("salt")
+	serverFirst := fmt.Sprintf("r=%vserver,s=%v,i=%v", parseSCRAMAttributes(clientFirstBare)["r"], base64.StdEncoding.EncodeToString(salt), iterations)
+	send('R', append(binary.BigEndian.AppendUint32(nil, postgresAuthenticationSASLContinue), serverFirst...))
+	messageType, payload, err = readPostgresMessage(reader)
+	if err != nil || messageType != 'p' {
+		return false
+	}
+	clientFinal := string(payload)
+	clientFinalWithoutProof, _, _ := strings.Cut(clientFinal, ",p=")
+	proof, err := base64.StdEncoding.DecodeString(parseSCRAMAttributes(clientFinal)["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return false
+	}
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if sha256.Sum256(clientKey) != storedKey {
+		return false
+	}
+
+	serverSignature := scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+	switch method {
+	case fakePostgresSCRAMNoFinal:
+		return true
+	case fakePostgresSCRAMBadFinal:
+		serverSignature[0] ^= 1
+	}
+	send('R', append(binary.BigEndian.AppendUint32(nil, postgresAuthenticationSASLFinal), "v="+base64.StdEncoding.EncodeToString(serverSignature)...))
+	return true
+}
+
+func readPostgresMessage(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func TestPostgresAction(t *testing.T) {
+	cleartextPort := startFakeServer(t, fakePostgresServer("probe", "hunter2", fakePostgresCleartext))
+	md5Port := startFakeServer(t, fakePostgresServer("probe", "hunter2", fakePostgresMD5))
+	scramPort := startFakeServer(t, fakePostgresServer("probe", "hunter2", fakePostgresSCRAM))
+	var scramPorts map[string]int = map[string]int{}
+	for _, method := range []string{fakePostgresSCRAMNoFinal, fakePostgresSCRAMBadFinal, fakePostgresSCRAMToCleartext, fakePostgresSCRAMIterations} {
+		scramPorts[method] = startFakeServer(t, fakePostgresServer("probe", "hunter2", method))
+	}
+	tests := []struct {
+		name     string
+		port     int
+		user     string
+		password string
+		query    *string
+		regex    *string
+		success  bool
+	}{
+		{name: "cleartext password", port: cleartextPort, user: "probe", password: "hunter2", success: true},
+		{name: "md5 password", port: md5Port, user: "probe", password: "hunter2", success: true},
+		{name: "scram password", port: scramPort, user: "probe", password: "hunter2", success: true},
+		{name: "query matches", port: md5Port, user: "probe", password: "hunter2", query: stringPointer("SELECT 1"), regex: stringPointer("^1$"), success: true},
+		{name: "unknown user", port: cleartextPort, user: "someone", password: "hunter2", success: false},
+		{name: "wrong cleartext password", port: cleartextPort, user: "probe", password: "hunter3", success: false},
+		{name: "wrong md5 password", port: md5Port, user: "probe", password: "hunter3", success: false},
+		{name: "wrong scram password", port: scramPort, user: "probe", password: "hunter3", success: false},
+		{name: "scram without server final", port: scramPorts[fakePostgresSCRAMNoFinal], user: "probe", password: "hunter2", success: false},
+		{name: "scram with bad server signature", port: scramPorts[fakePostgresSCRAMBadFinal], user: "probe", password: "hunter2", success: false},
+		{name: "cleartext after scram began", port: scramPorts[fakePostgresSCRAMToCleartext], user: "probe", password: "hunter2", success: false},
+		{name: "scram with too many iterations", port: scramPorts[fakePostgresSCRAMIterations], user: "probe", password: "hunter2", success: false},
+		{name: "query does not match", port: md5Port, user: "probe", password: "hunter2", query: stringPointer("SELECT 1"), regex: stringPointer("^2$"), success: false},
+		{name: "query fails", port: md5Port, user: "probe", password: "hunter2", query: stringPointer("SELEC 1"), success: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			postgresActionConfig := config.PostgresActionConfig{
+				ServerConfig: config.ServerConfig{Host: stringPointer("127.0.0.1"), Port: &test.port},
+				User:         test.user,
+				Password:     &config.SecretConfig{Value: &test.password},
+				Query:        test.query,
+				RegEx:        test.regex,
+			}
+			action := newPostgresAction(&postgresActionConfig, time.Second)
+			if action == nil {
+				t.Fatal("could not create postgres action")
+			}
+			success := action.act(context.Background(), test.name, nil, nil, nil)
+			if success != test.success {
+				t.Errorf("expected success to be %v but it was %v", test.success, success)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ProcessAction struct {
+	commandLineRegEx       *regexp.Regexp
+	maxCPUPercent          *float64
+	maxResidentMemoryBytes *uint64
+	maxOpenFDs             *int32
+	maxThreads             *int32
+	state                  *ProcessState
+	timeout                time.Duration
+}
+
+// what was seen the last time that the probe ran, so that restarts and CPU usage can be worked out
+type ProcessState struct {
+	mutex      sync.Mutex
+	pid        int32
+	createTime int64
+	cpuSeconds float64
+	sampleTime time.Time
+	restarts   int
+}
+
+func newProcessAction(processActionConfig *config.ProcessActionConfig, watchedProcessCommandLineRegEx *string, timeout time.Duration) *ProcessAction {
+	logger.Info("processing process probe config")
+	if processActionConfig == nil {
+		return nil
+	}
+
+	// defaults to the process that signals waits for
+	var commandLineRegExString *string = processActionConfig.CommandLineRegEx
+	if commandLineRegExString == nil {
+		commandLineRegExString = watchedProcessCommandLineRegEx
+	}
+	if commandLineRegExString == nil {
+		logger.Error("commandLineRegEx must be set for process action when signals.watchedProcessCommandLineRegEx isn't")
+		return nil
+	}
+	commandLineRegEx, err := regexp.Compile(*commandLineRegExString)
+	if err != nil {
+		logger.Error("error in commandLineRegEx for process action", "commandLineRegEx", *commandLineRegExString, "err", err)
+		return nil
+	}
+
+	return &ProcessAction{
+		commandLineRegEx:       commandLineRegEx,
+		maxCPUPercent:          processActionConfig.MaxCPUPercent,
+		maxResidentMemoryBytes: processActionConfig.MaxResidentMemoryBytes,
+		maxOpenFDs:             processActionConfig.MaxOpenFDs,
+		maxThreads:             processActionConfig.MaxThreads,
+		state:                  &ProcessState{},
+		timeout:                timeout,
+	}
+}
+
+func (action ProcessAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing process probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	_, span := (*tracer).Start(timeoutContext, "process-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.check(probeName, &span)
+	if message == "" && time.Now().After(timeoutTime) {
+		message = "probe failed - timed out"
+	}
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// samples the process, records the readings in the local TSDB,
+// and then returns an empty message if the process passes all of the checks and a message explaining why if it doesn't
+func (action ProcessAction) check(probeName string, span *trace.Span) string {
+	// the state is shared by runs of the probe which overlap (when the timeout is longer than the period)
+	action.state.mutex.Lock()
+	defer action.state.mutex.Unlock()
+
+	now := time.Now()
+	var sampleLabels map[string]string = map[string]string{"probe": probeName}
+	proc, commandLine, err := findProcess(action.commandLineRegEx)
+	if err != nil {
+		logger.Debug("could not get list of processes", "err", err)
+		return "probe failed - could not get list of processes"
+	}
+	if proc == nil {
+		appendSamples([]telemetry.Sample{
+			{Name: "bunny_process_exists", Labels: sampleLabels, Value: 0},
+			{Name: "bunny_process_restarts_total", Labels: sampleLabels, Value: float64(action.state.restarts)},
+		}, now)
+		return "probe failed - process not found"
+	}
+	(*span).SetAttributes(
+		attribute.Int("process.pid", int(proc.Pid)),
+		attribute.String("process.command_line", truncateForSpan([]byte(commandLine))),
+	)
+
+	// a different process id (or the same one reused by a new process) means that the app restarted
+	createTime, err := proc.CreateTime()
+	if err != nil {
+		logger.Debug("could not get create time of process", "proc.Pid", proc.Pid, "err", err)
+	}
+	restarted := action.state.pid != 0 && (proc.Pid != action.state.pid || createTime != action.state.createTime)
+	if restarted {
+		action.state.restarts++
+		action.state.sampleTime = time.Time{}
+	}
+	action.state.pid = proc.Pid
+	action.state.createTime = createTime
+	(*span).SetAttributes(attribute.Int("bunny.process.restarts", action.state.restarts))
+
+	var samples []telemetry.Sample = []telemetry.Sample{
+		{Name: "bunny_process_exists", Labels: sampleLabels, Value: 1},
+		{Name: "bunny_process_pid", Labels: sampleLabels, Value: float64(proc.Pid)},
+		{Name: "bunny_process_restarts_total", Labels: sampleLabels, Value: float64(action.state.restarts)},
+	}
+
+	// the CPU percent is over the time since the last run of the probe (100 is one whole core)
+	var cpuPercent *float64 = nil
+	times, err := proc.Times()
+	if err != nil {
+		logger.Debug("could not get cpu times of process", "proc.Pid", proc.Pid, "err", err)
+	} else {
+		cpuSeconds := times.User + times.System
+		if !action.state.sampleTime.IsZero() {
+			percent := (cpuSeconds - action.state.cpuSeconds) / now.Sub(action.state.sampleTime).Seconds() * 100
+			cpuPercent = &percent
+			samples = append(samples, telemetry.Sample{Name: "bunny_process_cpu_percent", Labels: sampleLabels, Value: percent})
+			(*span).SetAttributes(attribute.Float64("bunny.process.cpu_percent", percent))
+		}
+		action.state.cpuSeconds = cpuSeconds
+		action.state.sampleTime = now
+	}
+
+	var residentMemoryBytes *uint64 = nil
+	memoryInfo, err := proc.MemoryInfo()
+	if err != nil {
+		logger.Debug("could not get memory info of process", "proc.Pid", proc.Pid, "err", err)
+	} else {
+		residentMemoryBytes = &memoryInfo.RSS
+		samples = append(samples, telemetry.Sample{Name: "bunny_process_resident_memory_bytes", Labels: sampleLabels, Value: float64(memoryInfo.RSS)})
+		(*span).SetAttributes(attribute.Int64("bunny.process.resident_memory_bytes", int64(memoryInfo.RSS)))
+	}
+
+	// reading another user's file descriptors needs CAP_SYS_PTRACE
+	var openFDs *int32 = nil
+	numFDs, err := proc.NumFDs()
+	if err != nil {
+		logger.Debug("could not get number of open fds of process", "proc.Pid", proc.Pid, "err", err)
+	} else {
+		openFDs = &numFDs
+		samples = append(samples, telemetry.Sample{Name: "bunny_process_open_fds", Labels: sampleLabels, Value: float64(numFDs)})
+		(*span).SetAttributes(attribute.Int("bunny.process.open_fds", int(numFDs)))
+	}
+	rlimits, err := proc.Rlimit()
+	if err == nil {
+		for _, rlimit := range rlimits {
+			if rlimit.Resource == process.RLIMIT_NOFILE && rlimit.Soft > 0 {
+				samples = append(samples, telemetry.Sample{Name: "bunny_process_max_fds", Labels: sampleLabels, Value: float64(rlimit.Soft)})
+			}
+		}
+	}
+
+	var threads *int32 = nil
+	numThreads, err := proc.NumThreads()
+	if err != nil {
+		logger.Debug("could not get number of threads of process", "proc.Pid", proc.Pid, "err", err)
+	} else {
+		threads = &numThreads
+		samples = append(samples, telemetry.Sample{Name: "bunny_process_threads", Labels: sampleLabels, Value: float64(numThreads)})
+		(*span).SetAttributes(attribute.Int("bunny.process.threads", int(numThreads)))
+	}
+	appendSamples(samples, now)
+
+	// the CPU percent isn't known on the first run, so it can't fail the probe until the second
+	if action.maxCPUPercent != nil && cpuPercent != nil && *cpuPercent > *action.maxCPUPercent {
+		return fmt.Sprintf("probe failed - process is using %.1f%% cpu", *cpuPercent)
+	}
+	if action.maxResidentMemoryBytes != nil {
+		if residentMemoryBytes == nil {
+			return "probe failed - could not get memory info of process"
+		}
+		if *residentMemoryBytes > *action.maxResidentMemoryBytes {
+			return fmt.Sprintf("probe failed - process is using %v bytes of memory", *residentMemoryBytes)
+		}
+	}
+	if action.maxOpenFDs != nil {
+		if openFDs == nil {
+			return "probe failed - could not get number of open fds of process"
+		}
+		if *openFDs > *action.maxOpenFDs {
+			return fmt.Sprintf("probe failed - process has %v open fds", *openFDs)
+		}
+	}
+	if action.maxThreads != nil {
+		if threads == nil {
+			return "probe failed - could not get number of threads of process"
+		}
+		if *threads > *action.maxThreads {
+			return fmt.Sprintf("probe failed - process has %v threads", *threads)
+		}
+	}
+	return ""
+}
+
+// finds the first process (other than Bunny, whose own command line can match the regex) whose command line matches the regex
+// returns a nil process if none match
+// this needs the app to be in the same process namespace as Bunny (like with shareProcessNamespace in Kubernetes)
+func findProcess(commandLineRegEx *regexp.Regexp) (*process.Process, string, error) {
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, proc := range processes {
+		if proc.Pid == int32(os.Getpid()) {
+			continue
+		}
+		// processes can exit while we're looking at them
+		commandLine, err := proc.Cmdline()
+		if err != nil {
+			continue
+		}
+		if commandLineRegEx.MatchString(commandLine) {
+			return proc, commandLine, nil
+		}
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,223 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/common"
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+type RedisAction struct {
+	server         *Server
+	username       *string
+	password       *config.SecretConfig
+	role           string
+	infoAssertions []FieldAssertion
+	timeout        time.Duration
+}
+
+const defaultRedisPort int = 6379
+
+// the largest reply that we'll read (INFO replication is usually well under 1KiB)
+const redisReplyLimitBytes int = 1024 * 1024
+
+func newRedisAction(redisActionConfig *config.RedisActionConfig, timeout time.Duration) *RedisAction {
+	logger.Info("processing redis probe config")
+	if redisActionConfig == nil {
+		return nil
+	}
+
+	server := newServer(&redisActionConfig.ServerConfig, defaultRedisPort)
+	if server == nil {
+		logger.Error("could not process server for redis probe config")
+		return nil
+	}
+
+	// redis calls replicas "slave" in INFO
+	var role string = ""
+	if redisActionConfig.Role != nil {
+		role = strings.ToLower(*redisActionConfig.Role)
+		if role == "replica" {
+			role = "slave"
+		}
+		if role != "master" && role != "slave" {
+			logger.Error("role for redis action is neither master nor replica", "redisActionConfig.Role", *redisActionConfig.Role)
+			return nil
+		}
+	}
+
+	infoAssertions, ok := newFieldAssertions(redisActionConfig.Info)
+	if !ok {
+		return nil
+	}
+
+	return &RedisAction{
+		server:         server,
+		username:       redisActionConfig.Username,
+		password:       redisActionConfig.Password,
+		role:           role,
+		infoAssertions: infoAssertions,
+		timeout:        timeout,
+	}
+}
+
+func (action RedisAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing redis probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "redis-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("db.system", "redis"))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	connection, err := action.server.connect(spanContext, timeoutTime, &span)
+	if err != nil {
+		message := "probe failed - could not connect to redis server"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer connection.Close()
+
+	client := RedisClient{readWriter: bufio.NewReadWriter(bufio.NewReader(connection), bufio.NewWriter(connection))}
+	message := action.check(&client)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// returns an empty message if the server passes all of the checks and a message explaining why if it doesn't
+func (action RedisAction) check(client *RedisClient) string {
+	if action.password != nil {
+		password, err := common.ReadSecret(action.password)
+		if err != nil {
+			logger.Error("could not read password for redis probe", "err", err)
+			return "probe failed - could not read password"
+		}
+		command := []string{"AUTH", password}
+		if action.username != nil {
+			command = []string{"AUTH", *action.username, password}
+		}
+		_, err = client.do(command...)
+		if err != nil {
+			logger.Debug("redis AUTH failed", "err", err)
+			return "probe failed - redis AUTH failed"
+		}
+	}
+
+	reply, err := client.do("PING")
+	if err != nil || reply != "PONG" {
+		logger.Debug("redis PING failed", "reply", reply, "err", err)
+		return "probe failed - redis PING failed"
+	}
+
+	if action.role == "" && len(action.infoAssertions) == 0 {
+		return ""
+	}
+	reply, err = client.do("INFO", "replication")
+	if err != nil {
+		logger.Debug("redis INFO failed", "err", err)
+		return "probe failed - redis INFO failed"
+	}
+	fields := parseRedisInfo(reply)
+	if action.role != "" && fields["role"] != action.role {
+		return fmt.Sprintf("probe failed - unexpected redis role: %v", fields["role"])
+	}
+	return checkFieldAssertions(action.infoAssertions, fields)
+}
+
+// just enough of RESP to send commands and read the replies to them
+// see: https://redis.io/docs/reference/protocol-spec/
+type RedisClient struct {
+	readWriter *bufio.ReadWriter
+}
+
+// error replies are returned as errors
+func (client *RedisClient) do(command ...string) (string, error) {
+	fmt.Fprintf(client.readWriter, "*%d\r\n", len(command))
+	for _, argument := range command {
+		fmt.Fprintf(client.readWriter, "$%d\r\n%s\r\n", len(argument), argument)
+	}
+	err := client.readWriter.Flush()
+	if err != nil {
+		return "", err
+	}
+	return client.readReply()
+}
+
+func (client *RedisClient) readReply() (string, error) {
+	line, err := client.readWriter.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return "", errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			return "", nil
+		}
+		if length > redisReplyLimitBytes {
+			return "", errors.New("redis reply is too large")
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(client.readWriter, data)
+		if err != nil {
+			return "", err
+		}
+		return string(data[:length]), nil
+	}
+	return "", fmt.Errorf("unsupported redis reply type: %q", line[0])
+}
+
+// INFO replies have "# Section" headers and "field:value" lines
+func parseRedisInfo(info string) map[string]string {
+	var fields map[string]string = map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if found {
+			fields[name] = value
+		}
+	}
+	return fields
+}
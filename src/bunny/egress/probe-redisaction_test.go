@@ -0,0 +1,121 @@
+package egress
+
+import (
+	"bufio"
+	"bunny/config"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a RESP server that knows AUTH, PING, and INFO replication
+// an empty password means that AUTH isn't needed
+func fakeRedisServer(password string, role string) func(connection net.Conn) {
+	return func(connection net.Conn) {
+		reader := bufio.NewReader(connection)
+		authenticated := password == ""
+		for {
+			command, err := readRESPCommand(reader)
+			if err != nil {
+				return
+			}
+			var reply string
+			switch strings.ToUpper(command[0]) {
+			case "AUTH":
+				// AUTH password or AUTH username password
+				if command[len(command)-1] == password {
+					authenticated = true
+					reply = "+OK\r\n"
+				} else {
+					reply = "-WRONGPASS invalid username-password pair\r\n"
+				}
+			case "PING":
+				if authenticated {
+					reply = "+PONG\r\n"
+				} else {
+					reply = "-NOAUTH Authentication required.\r\n"
+				}
+			case "INFO":
+				info := fmt.Sprintf("# Replication\r\nrole:%v\r\nconnected_slaves:1\r\n", role)
+				reply = fmt.Sprintf("$%d\r\n%v\r\n", len(info), info)
+			default:
+				reply = "-ERR unknown command\r\n"
+			}
+			connection.Write([]byte(reply))
+		}
+	}
+}
+
+// commands are arrays of bulk strings
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	var command []string = []string{}
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		command = append(command, string(data[:length]))
+	}
+	return command, nil
+}
+
+func TestRedisAction(t *testing.T) {
+	port := startFakeServer(t, fakeRedisServer("hunter2", "master"))
+	tests := []struct {
+		name     string
+		password *string
+		role     *string
+		info     []config.FieldAssertionConfig
+		success  bool
+	}{
+		{name: "ping", password: stringPointer("hunter2"), success: true},
+		{name: "role and info", password: stringPointer("hunter2"), role: stringPointer("master"), info: []config.FieldAssertionConfig{{Name: "connected_slaves", RegEx: "^[1-9]"}}, success: true},
+		{name: "no password", success: false},
+		{name: "wrong password", password: stringPointer("hunter3"), success: false},
+		{name: "wrong role", password: stringPointer("hunter2"), role: stringPointer("replica"), success: false},
+		{name: "info does not match", password: stringPointer("hunter2"), info: []config.FieldAssertionConfig{{Name: "connected_slaves", RegEx: "^0$"}}, success: false},
+		{name: "info field missing", password: stringPointer("hunter2"), info: []config.FieldAssertionConfig{{Name: "master_link_status", RegEx: "^up$"}}, success: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redisActionConfig := config.RedisActionConfig{
+				ServerConfig: config.ServerConfig{Host: stringPointer("127.0.0.1"), Port: &port},
+				Role:         test.role,
+				Info:         test.info,
+			}
+			if test.password != nil {
+				redisActionConfig.Password = &config.SecretConfig{Value: test.password}
+			}
+			action := newRedisAction(&redisActionConfig, time.Second)
+			if action == nil {
+				t.Fatal("could not create redis action")
+			}
+			success := action.act(context.Background(), test.name, nil, nil, nil)
+			if success != test.success {
+				t.Errorf("expected success to be %v but it was %v", test.success, success)
+			}
+		})
+	}
+}
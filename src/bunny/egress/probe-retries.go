@@ -0,0 +1,108 @@
+package egress
+
+import (
+	"bunny/telemetry"
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runs the probe's action until it succeeds or it has been retried probe.Retries times, returning whether it succeeded
+// all of the attempts (and the backoffs between them) share the probe's timeout, so retries don't make a probe run for longer
+// each attempt gets an equal share of what's left of the timeout after the backoffs still to come, so an attempt that
+// times out (like one whose packet was dropped) leaves time for the retries after it
+func runProbe(probe *Probe) bool {
+	probeAction := *probe.ProbeAction
+	deadline := time.Now().Add(probe.Timeout)
+	deadlineContext, deadlineContextCancelFunc := context.WithDeadlineCause(context.Background(), deadline, context.DeadlineExceeded)
+	defer deadlineContextCancelFunc()
+
+	// without retries, the attempt's span is the probe's span (like it was before retries were added)
+	var spanContext context.Context = deadlineContext
+	var span trace.Span = nil
+	if probe.Retries > 0 {
+		spanContext, span = (*tracer).Start(deadlineContext, "retried-probe")
+		span.SetAttributes(attribute.KeyValue{
+			Key:   "bunny-probe-name",
+			Value: attribute.StringValue(probe.Name),
+		})
+		span.SetAttributes(attribute.Int("bunny.probe.retries", probe.Retries))
+		defer span.End()
+	}
+
+	var success bool = false
+	var attempts int = 0
+	backoff := probe.RetryBackoff
+	for {
+		// an attempt that finishes early leaves the rest of its share to the attempts after it
+		attemptsLeft := probe.Retries + 1 - attempts
+		attemptTimeout := (time.Until(deadline) - totalBackoff(backoff, attemptsLeft-1)) / time.Duration(attemptsLeft)
+		if attemptTimeout <= 0 {
+			logger.Debug("no time left to attempt probe", "probe", probe.Name, "attempts", attempts)
+			break
+		}
+		attempts++
+		attemptContext, attemptContextCancelFunc := context.WithTimeoutCause(spanContext, attemptTimeout, context.DeadlineExceeded)
+		success = probeAction.act(attemptContext, probe.Name, probe.AttemptsMetric, probe.ResponseTimeMetric, probe.SuccessesMetric)
+		attemptContextCancelFunc()
+		if success || attempts > probe.Retries {
+			break
+		}
+		logger.Debug("retrying probe", "probe", probe.Name, "attempts", attempts, "backoff", backoff)
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("bunny.probe.attempt", attempts+1),
+			attribute.Int64("bunny.probe.backoff_milliseconds", backoff.Milliseconds()),
+		))
+		backoffTimer := time.NewTimer(backoff)
+		select {
+		case <-backoffTimer.C:
+		case <-deadlineContext.Done():
+			backoffTimer.Stop()
+		}
+		if deadlineContext.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+
+	if success && attempts == 1 {
+		telemetry.IncCounter(probe.FirstTrySuccessesMetric)
+	} else if success {
+		telemetry.IncCounter(probe.SuccessesAfterRetryMetric)
+	} else {
+		telemetry.IncCounter(probe.RetriesExhaustedMetric)
+	}
+	if span != nil {
+		span.SetAttributes(attribute.Int("bunny.probe.attempts", attempts))
+		if success {
+			span.SetStatus(codes.Ok, "probe succeeded")
+		} else {
+			span.SetStatus(codes.Error, fmt.Sprintf("probe failed - no attempt succeeded (%v of %v)", attempts, probe.Retries+1))
+		}
+	}
+	return success
+}
+
+// the time spent waiting between the given number of retries, starting with the given backoff
+func totalBackoff(backoff time.Duration, retries int) time.Duration {
+	var total time.Duration = 0
+	for i := 0; i < retries; i++ {
+		total += backoff
+		backoff *= 2
+	}
+	return total
+}
+
+// an attempt stops at the probe's timeout or at ctx's deadline (when the probe's attempts run out of time), whichever is first
+func attemptDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	ctxDeadline, ok := ctx.Deadline()
+	if ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
@@ -0,0 +1,470 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ScenarioAction struct {
+	baseURL        string
+	transport      http.RoundTripper
+	readLimitBytes int
+	steps          []ScenarioStep
+	timeout        time.Duration
+}
+
+// one HTTP request in a scenario
+// the path, header values, and body can use the variables extracted by earlier steps (for example "Bearer {{.token}}")
+type ScenarioStep struct {
+	name               string
+	method             string
+	path               string
+	pathTemplate       *template.Template
+	headers            []ScenarioHeader
+	body               string
+	bodyTemplate       *template.Template
+	expectStatusCodes  []int
+	expectHeaders      []FieldAssertion
+	jsonPathAssertions []JSONPathAssertion
+	extractions        []ScenarioExtraction
+}
+
+type ScenarioHeader struct {
+	name      string
+	values    []string
+	templates []*template.Template
+}
+
+// sets a variable from the response, from either a JSONPath into the body, a header, or a regex on the body
+type ScenarioExtraction struct {
+	variable string
+	jsonPath string
+	header   string
+	regex    *regexp.Regexp
+}
+
+// how much of each response is read unless readLimitBytes is set
+const defaultScenarioReadLimitBytes int = 1024 * 1024
+
+func newScenarioAction(scenarioActionConfig *config.ScenarioActionConfig, timeout time.Duration) *ScenarioAction {
+	logger.Info("processing scenario probe config")
+	if scenarioActionConfig == nil {
+		return nil
+	}
+	var host string = "localhost"
+	if scenarioActionConfig.Host != nil && *scenarioActionConfig.Host != "" {
+		host = *scenarioActionConfig.Host
+	}
+	var scheme string = "http"
+	if scenarioActionConfig.Scheme != nil {
+		scheme = strings.ToLower(*scenarioActionConfig.Scheme)
+		if scheme != "http" && scheme != "https" {
+			logger.Error("scheme for scenario action is neither http nor https")
+			return nil
+		}
+	}
+	unixSocketPath, ok := newUnixSocketPath(scenarioActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+	var baseURL string = fmt.Sprintf("%s://%s:%d", scheme, host, scenarioActionConfig.Port)
+	if unixSocketPath != "" && scenarioActionConfig.Port == 0 {
+		// the host is still used in the url (and so for the Host header) but the port is meaningless for a unix socket
+		baseURL = fmt.Sprintf("%s://%s", scheme, host)
+	}
+	var readLimitBytes int = defaultScenarioReadLimitBytes
+	if scenarioActionConfig.ReadLimitBytes != nil {
+		if *scenarioActionConfig.ReadLimitBytes <= 0 {
+			logger.Error("readLimitBytes must be greater than 0 for scenario action", "scenarioActionConfig.ReadLimitBytes", *scenarioActionConfig.ReadLimitBytes)
+			return nil
+		}
+		readLimitBytes = *scenarioActionConfig.ReadLimitBytes
+	}
+
+	if len(scenarioActionConfig.Steps) == 0 {
+		logger.Error("steps must be set for scenario action")
+		return nil
+	}
+	var steps []ScenarioStep = []ScenarioStep{}
+	for i, stepConfig := range scenarioActionConfig.Steps {
+		step := newScenarioStep(&stepConfig, i)
+		if step == nil {
+			logger.Error("could not process steps for scenario probe config")
+			return nil
+		}
+		steps = append(steps, *step)
+	}
+
+	// create Transport the same way as for httpGet
+	transport := &http.Transport{
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives:  true,
+		Proxy:              http.ProxyURL(nil),
+		DisableCompression: true,
+		DialContext:        newDialer().DialContext,
+	}
+	if unixSocketPath != "" {
+		transport.DialContext = newUnixSocketDialContext(unixSocketPath)
+	}
+
+	return &ScenarioAction{
+		baseURL:        baseURL,
+		transport:      otelhttp.NewTransport(transport),
+		readLimitBytes: readLimitBytes,
+		steps:          steps,
+		timeout:        timeout,
+	}
+}
+
+func newScenarioStep(stepConfig *config.ScenarioStepConfig, index int) *ScenarioStep {
+	var name string = fmt.Sprintf("step-%d", index+1)
+	if stepConfig.Name != nil && *stepConfig.Name != "" {
+		name = *stepConfig.Name
+	}
+	var method string = http.MethodGet
+	if stepConfig.Method != nil {
+		method = strings.ToUpper(*stepConfig.Method)
+	}
+	path := "/" + strings.TrimPrefix(stepConfig.Path, "/")
+	pathTemplate, err := newExpectTemplate(path)
+	if err != nil {
+		logger.Error("could not parse template for path of scenario step", "name", name, "err", err)
+		return nil
+	}
+
+	var headers []ScenarioHeader = []ScenarioHeader{}
+	for _, httpHeadersConfig := range stepConfig.HTTPHeaders {
+		header := ScenarioHeader{name: httpHeadersConfig.Name, values: httpHeadersConfig.Value}
+		for _, value := range httpHeadersConfig.Value {
+			valueTemplate, err := newExpectTemplate(value)
+			if err != nil {
+				logger.Error("could not parse template for header of scenario step", "name", name, "header", httpHeadersConfig.Name, "err", err)
+				return nil
+			}
+			header.templates = append(header.templates, valueTemplate)
+		}
+		headers = append(headers, header)
+	}
+
+	var body string = ""
+	var bodyTemplate *template.Template = nil
+	if stepConfig.Body != nil {
+		body = *stepConfig.Body
+		bodyTemplate, err = newExpectTemplate(body)
+		if err != nil {
+			logger.Error("could not parse template for body of scenario step", "name", name, "err", err)
+			return nil
+		}
+	}
+
+	expectHeaders, ok := newFieldAssertions(stepConfig.ExpectHeaders)
+	if !ok {
+		return nil
+	}
+	jsonPathAssertions, ok := newJSONPathAssertions(stepConfig.JSONPath)
+	if !ok {
+		return nil
+	}
+
+	var extractions []ScenarioExtraction = []ScenarioExtraction{}
+	for _, extractConfig := range stepConfig.Extract {
+		extraction := newScenarioExtraction(&extractConfig)
+		if extraction == nil {
+			logger.Error("could not process extract for scenario step", "name", name)
+			return nil
+		}
+		extractions = append(extractions, *extraction)
+	}
+
+	return &ScenarioStep{
+		name:               name,
+		method:             method,
+		path:               path,
+		pathTemplate:       pathTemplate,
+		headers:            headers,
+		body:               body,
+		bodyTemplate:       bodyTemplate,
+		expectStatusCodes:  stepConfig.ExpectStatusCodes,
+		expectHeaders:      expectHeaders,
+		jsonPathAssertions: jsonPathAssertions,
+		extractions:        extractions,
+	}
+}
+
+func newScenarioExtraction(extractConfig *config.ScenarioExtractConfig) *ScenarioExtraction {
+	if extractConfig.Variable == "" {
+		logger.Error("variable must be set for extract")
+		return nil
+	}
+	// an empty source counts as set but wouldn't extract anything (and would leave the other sources unset when the probe runs)
+	if (extractConfig.JSONPath != nil && strings.TrimSpace(*extractConfig.JSONPath) == "") || (extractConfig.Header != nil && *extractConfig.Header == "") || (extractConfig.RegEx != nil && *extractConfig.RegEx == "") {
+		logger.Error("jsonPath, header, and regex must not be empty for extract", "extractConfig.Variable", extractConfig.Variable)
+		return nil
+	}
+	var sources int = 0
+	extraction := ScenarioExtraction{variable: extractConfig.Variable}
+	if extractConfig.JSONPath != nil {
+		sources++
+		path, err := newJSONPath(*extractConfig.JSONPath)
+		if err != nil {
+			logger.Error("error in jsonPath for extract", "extractConfig.JSONPath", *extractConfig.JSONPath, "err", err)
+			return nil
+		}
+		extraction.jsonPath = path
+	}
+	if extractConfig.Header != nil {
+		sources++
+		extraction.header = *extractConfig.Header
+	}
+	if extractConfig.RegEx != nil {
+		sources++
+		regex, err := regexp.Compile(*extractConfig.RegEx)
+		if err != nil {
+			logger.Error("error in regex for extract", "extractConfig.RegEx", *extractConfig.RegEx, "err", err)
+			return nil
+		}
+		extraction.regex = regex
+	}
+	if sources != 1 {
+		logger.Error("exactly one of jsonPath, header, or regex must be set for extract", "extractConfig.Variable", extractConfig.Variable)
+		return nil
+	}
+	return &extraction
+}
+
+func (action ScenarioAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing scenario probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "scenario-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.Int("bunny.scenario.steps", len(action.steps)))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.run(spanContext, &span)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// runs the steps in order with a new session (cookie jar and variables) each time
+// returns an empty message if every step succeeded and a message naming the step that failed if one didn't
+func (action ScenarioAction) run(ctx context.Context, span *trace.Span) string {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return "probe failed - could not create cookie jar"
+	}
+	// redirects are followed, with the cookies set by them kept in the jar
+	client := &http.Client{
+		Timeout:   action.timeout,
+		Transport: action.transport,
+		Jar:       jar,
+	}
+	variables := newExpectVariables(span)
+	for i, step := range action.steps {
+		message := action.do(ctx, client, variables, &step, i)
+		if message != "" {
+			(*span).SetAttributes(
+				attribute.String("bunny.scenario.failed_step", step.name),
+				attribute.Int("bunny.scenario.failed_step_index", i),
+			)
+			return fmt.Sprintf("probe failed - step %v: %v", step.name, message)
+		}
+	}
+	return ""
+}
+
+// returns an empty message if the step succeeded and a message explaining why if it didn't
+func (action ScenarioAction) do(ctx context.Context, client *http.Client, variables ExpectVariables, step *ScenarioStep, index int) string {
+	// each step gets its own span, which is the parent of the span for its HTTP request
+	stepContext, stepSpan := (*tracer).Start(ctx, step.name)
+	defer stepSpan.End()
+	stepSpan.SetAttributes(
+		attribute.Int("bunny.scenario.step_index", index),
+		attribute.String("http.request.method", step.method),
+	)
+	message := action.doRequest(stepContext, client, variables, step, &stepSpan)
+	if message != "" {
+		stepSpan.SetStatus(codes.Error, message)
+		return message
+	}
+	stepSpan.SetStatus(codes.Ok, "scenario step succeeded")
+	return ""
+}
+
+func (action ScenarioAction) doRequest(ctx context.Context, client *http.Client, variables ExpectVariables, step *ScenarioStep, stepSpan *trace.Span) string {
+	path, err := fillScenarioTemplate(variables, step.path, step.pathTemplate)
+	if err != nil {
+		logger.Debug("could not fill in template for path", "step.name", step.name, "err", err)
+		return "could not fill in template for path"
+	}
+	(*stepSpan).SetAttributes(attribute.String("url.path", path))
+	body, err := fillScenarioTemplate(variables, step.body, step.bodyTemplate)
+	if err != nil {
+		logger.Debug("could not fill in template for body", "step.name", step.name, "err", err)
+		return "could not fill in template for body"
+	}
+	var bodyReader io.Reader = nil
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, step.method, action.baseURL+path, bodyReader)
+	if err != nil {
+		logger.Debug("could not build request", "step.name", step.name, "err", err)
+		return "could not build request"
+	}
+	request.Close = true // disable keep alives to force creation of new connections on each request
+	for _, header := range step.headers {
+		for i, value := range header.values {
+			value, err = fillScenarioTemplate(variables, value, header.templates[i])
+			if err != nil {
+				logger.Debug("could not fill in template for header", "step.name", step.name, "header", header.name, "err", err)
+				return "could not fill in template for header " + header.name
+			}
+			// the Host header isn't sent from request.Header
+			if strings.EqualFold(header.name, "Host") {
+				request.Host = value
+				continue
+			}
+			request.Header.Add(header.name, value)
+		}
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		(*stepSpan).RecordError(err)
+		logger.Debug("no response", "step.name", step.name, "err", err)
+		return "no response"
+	}
+	defer response.Body.Close()
+	(*stepSpan).SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, int64(action.readLimitBytes)))
+	if err != nil {
+		logger.Debug("could not read response body", "step.name", step.name, "err", err)
+		return "could not read response body"
+	}
+	if !step.expectsStatusCode(response.StatusCode) {
+		return fmt.Sprintf("http response not ok: %v", response.StatusCode)
+	}
+	for _, expectHeader := range step.expectHeaders {
+		values := response.Header.Values(expectHeader.name)
+		if len(values) == 0 {
+			return "no " + expectHeader.name + " header"
+		}
+		if !expectHeader.regex.MatchString(values[0]) {
+			logger.Debug("header did not match regex", "step.name", step.name, "name", expectHeader.name, "value", values[0])
+			return expectHeader.name + " header did not match regex"
+		}
+	}
+
+	// the body is only parsed as JSON when something needs it
+	var data interface{} = nil
+	if len(step.jsonPathAssertions) > 0 || step.extractsJSON() {
+		err = json.Unmarshal(responseBody, &data)
+		if err != nil {
+			logger.Debug("could not parse response body as json", "step.name", step.name, "err", err)
+			return "could not parse response body as json"
+		}
+	}
+	if !checkJSONPathAssertions(step.jsonPathAssertions, data) {
+		logger.Debug("jsonPath assertions failed", "step.name", step.name, "response", truncateForSpan(responseBody))
+		return "jsonPath assertions failed"
+	}
+	for _, extraction := range step.extractions {
+		value, message := extraction.extract(response, responseBody, data)
+		if message != "" {
+			return message
+		}
+		variables[extraction.variable] = value
+		logger.Debug("extracted variable", "name", extraction.variable, "value", value)
+	}
+	return ""
+}
+
+// without expectStatusCodes, any 2xx is ok
+func (step *ScenarioStep) expectsStatusCode(statusCode int) bool {
+	if len(step.expectStatusCodes) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	for _, expectStatusCode := range step.expectStatusCodes {
+		if statusCode == expectStatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (step *ScenarioStep) extractsJSON() bool {
+	for _, extraction := range step.extractions {
+		if extraction.jsonPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the value, or a message explaining why it couldn't be extracted
+func (extraction ScenarioExtraction) extract(response *http.Response, body []byte, data interface{}) (string, string) {
+	if extraction.jsonPath != "" {
+		value, err := evaluateJSONPath(extraction.jsonPath, data)
+		if err != nil {
+			logger.Debug("could not extract variable with jsonPath", "variable", extraction.variable, "err", err)
+			return "", "could not extract " + extraction.variable + " with jsonPath"
+		}
+		return value, ""
+	}
+	if extraction.header != "" {
+		values := response.Header.Values(extraction.header)
+		if len(values) == 0 {
+			return "", "could not extract " + extraction.variable + " - no " + extraction.header + " header"
+		}
+		return values[0], ""
+	}
+	// the first capture group if there is one and otherwise the whole match
+	matches := extraction.regex.FindSubmatch(body)
+	if matches == nil {
+		return "", "could not extract " + extraction.variable + " - regex did not match"
+	}
+	if len(matches) > 1 {
+		return string(matches[1]), ""
+	}
+	return string(matches[0]), ""
+}
+
+func fillScenarioTemplate(variables ExpectVariables, text string, textTemplate *template.Template) (string, error) {
+	if textTemplate == nil {
+		return text, nil
+	}
+	return variables.fill(textTemplate, false)
+}
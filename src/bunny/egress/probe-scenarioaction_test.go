@@ -0,0 +1,32 @@
+package egress
+
+import (
+	"bunny/config"
+	"testing"
+)
+
+func TestNewScenarioExtraction(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.ScenarioExtractConfig
+		valid  bool
+	}{
+		{name: "jsonPath", config: config.ScenarioExtractConfig{Variable: "token", JSONPath: stringPointer("$.token")}, valid: true},
+		{name: "header", config: config.ScenarioExtractConfig{Variable: "token", Header: stringPointer("X-Token")}, valid: true},
+		{name: "regex", config: config.ScenarioExtractConfig{Variable: "token", RegEx: stringPointer(`token=(\w+)`)}, valid: true},
+		{name: "no variable", config: config.ScenarioExtractConfig{Header: stringPointer("X-Token")}, valid: false},
+		{name: "no source", config: config.ScenarioExtractConfig{Variable: "token"}, valid: false},
+		{name: "two sources", config: config.ScenarioExtractConfig{Variable: "token", Header: stringPointer("X-Token"), RegEx: stringPointer(`\w+`)}, valid: false},
+		{name: "empty jsonPath", config: config.ScenarioExtractConfig{Variable: "token", JSONPath: stringPointer(" ")}, valid: false},
+		{name: "empty header", config: config.ScenarioExtractConfig{Variable: "token", Header: stringPointer("")}, valid: false},
+		{name: "empty regex", config: config.ScenarioExtractConfig{Variable: "token", RegEx: stringPointer("")}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extraction := newScenarioExtraction(&test.config)
+			if (extraction != nil) != test.valid {
+				t.Errorf("expected valid to be %v but it was %v", test.valid, extraction != nil)
+			}
+		})
+	}
+}
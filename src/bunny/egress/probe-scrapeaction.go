@@ -0,0 +1,330 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/textparse"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ScrapeAction struct {
+	headers              map[string][]string
+	url                  string
+	client               *http.Client
+	sampleLimit          int
+	bodySizeLimitBytes   int
+	metricRelabelConfigs []*relabel.Config
+	timeout              time.Duration
+}
+
+// each sample is a series in the head of the local TSDB, which is held in memory,
+// so an app that suddenly exposes a lot more series could push Bunny past GOMEMLIMIT
+const defaultScrapeSampleLimit int = 10000
+
+const defaultScrapeBodySizeLimitBytes int = 10 * 1024 * 1024
+
+// the same Accept header that Prometheus sends (without protobuf, which is only needed for native histograms)
+const scrapeAcceptHeader string = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+var relabelActions []relabel.Action = []relabel.Action{
+	relabel.Replace, relabel.Keep, relabel.Drop, relabel.KeepEqual, relabel.DropEqual, relabel.HashMod,
+	relabel.LabelMap, relabel.LabelDrop, relabel.LabelKeep, relabel.Lowercase, relabel.Uppercase,
+}
+
+func newScrapeAction(scrapeActionConfig *config.ScrapeActionConfig, timeout time.Duration) *ScrapeAction {
+	logger.Info("processing scrape probe config")
+	if scrapeActionConfig == nil {
+		return nil
+	}
+	var host string = "localhost"
+	if scrapeActionConfig.Host != nil && *scrapeActionConfig.Host != "" {
+		host = *scrapeActionConfig.Host
+	}
+	var scheme string = "http"
+	if scrapeActionConfig.Scheme != nil {
+		scheme = strings.ToLower(*scrapeActionConfig.Scheme)
+		if scheme != "http" && scheme != "https" {
+			logger.Error("scheme for scrape action is neither http nor https")
+			return nil
+		}
+	}
+	var path string = "metrics"
+	if scrapeActionConfig.Path != nil {
+		path = strings.TrimPrefix(*scrapeActionConfig.Path, "/")
+	}
+	unixSocketPath, ok := newUnixSocketPath(scrapeActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+	var url string = fmt.Sprintf("%s://%s:%d/%s", scheme, host, scrapeActionConfig.Port, path)
+	if unixSocketPath != "" && scrapeActionConfig.Port == 0 {
+		// the host is still used in the url (and so for the Host header) but the port is meaningless for a unix socket
+		url = fmt.Sprintf("%s://%s/%s", scheme, host, path)
+	}
+	logger.Debug("built url", "url", url)
+
+	var sampleLimit int = defaultScrapeSampleLimit
+	if scrapeActionConfig.SampleLimit != nil {
+		if *scrapeActionConfig.SampleLimit <= 0 {
+			logger.Error("sampleLimit must be greater than 0 for scrape action", "scrapeActionConfig.SampleLimit", *scrapeActionConfig.SampleLimit)
+			return nil
+		}
+		sampleLimit = *scrapeActionConfig.SampleLimit
+	}
+	var bodySizeLimitBytes int = defaultScrapeBodySizeLimitBytes
+	if scrapeActionConfig.BodySizeLimitBytes != nil {
+		if *scrapeActionConfig.BodySizeLimitBytes <= 0 {
+			logger.Error("bodySizeLimitBytes must be greater than 0 for scrape action", "scrapeActionConfig.BodySizeLimitBytes", *scrapeActionConfig.BodySizeLimitBytes)
+			return nil
+		}
+		bodySizeLimitBytes = *scrapeActionConfig.BodySizeLimitBytes
+	}
+
+	var metricRelabelConfigs []*relabel.Config = []*relabel.Config{}
+	for _, relabelConfig := range scrapeActionConfig.MetricRelabelConfigs {
+		metricRelabelConfig, err := newRelabelConfig(&relabelConfig)
+		if err != nil {
+			logger.Error("error in metricRelabelConfigs for scrape action", "err", err)
+			return nil
+		}
+		metricRelabelConfigs = append(metricRelabelConfigs, metricRelabelConfig)
+	}
+
+	// create Transport the same way as for httpGet
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+		Proxy:             http.ProxyURL(nil),
+		DialContext:       newDialer().DialContext,
+	}
+	if unixSocketPath != "" {
+		transport.DialContext = newUnixSocketDialContext(unixSocketPath)
+	}
+	client := &http.Client{
+		Timeout:       timeout,
+		Transport:     otelhttp.NewTransport(transport),
+		CheckRedirect: nil,
+	}
+
+	// convert the headers into a map now so we don't have to do it later for each request
+	var headers = map[string][]string{}
+	for _, httpHeadersConfig := range scrapeActionConfig.HTTPHeaders {
+		headers[httpHeadersConfig.Name] = httpHeadersConfig.Value
+	}
+	if _, found := headers["Accept"]; !found {
+		headers["Accept"] = []string{scrapeAcceptHeader}
+	}
+
+	return &ScrapeAction{
+		headers:              headers,
+		url:                  url,
+		client:               client,
+		sampleLimit:          sampleLimit,
+		bodySizeLimitBytes:   bodySizeLimitBytes,
+		metricRelabelConfigs: metricRelabelConfigs,
+		timeout:              timeout,
+	}
+}
+
+// builds a Prometheus relabel config, with the same defaults as in a Prometheus config file
+func newRelabelConfig(relabelConfig *config.RelabelConfig) (*relabel.Config, error) {
+	var metricRelabelConfig relabel.Config = relabel.DefaultRelabelConfig
+	for _, sourceLabel := range relabelConfig.SourceLabels {
+		metricRelabelConfig.SourceLabels = append(metricRelabelConfig.SourceLabels, model.LabelName(sourceLabel))
+	}
+	if relabelConfig.Separator != nil {
+		metricRelabelConfig.Separator = *relabelConfig.Separator
+	}
+	if relabelConfig.RegEx != nil {
+		regex, err := relabel.NewRegexp(*relabelConfig.RegEx)
+		if err != nil {
+			return nil, err
+		}
+		metricRelabelConfig.Regex = regex
+	}
+	if relabelConfig.Modulus != nil {
+		metricRelabelConfig.Modulus = *relabelConfig.Modulus
+	}
+	if relabelConfig.TargetLabel != nil {
+		metricRelabelConfig.TargetLabel = *relabelConfig.TargetLabel
+	}
+	if relabelConfig.Replacement != nil {
+		metricRelabelConfig.Replacement = *relabelConfig.Replacement
+	}
+	if relabelConfig.Action != nil {
+		metricRelabelConfig.Action = relabel.Action(strings.ToLower(*relabelConfig.Action))
+		if !isRelabelAction(metricRelabelConfig.Action) {
+			return nil, fmt.Errorf("unknown relabel action %q", *relabelConfig.Action)
+		}
+	}
+	err := metricRelabelConfig.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &metricRelabelConfig, nil
+}
+
+func isRelabelAction(action relabel.Action) bool {
+	for _, relabelAction := range relabelActions {
+		if action == relabelAction {
+			return true
+		}
+	}
+	return false
+}
+
+func (action ScrapeAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing scrape probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "scrape-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("url.full", action.url))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	message := action.scrape(spanContext, probeName, &span)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// fetches the metrics, relabels them, and appends them to the local TSDB along with how the scrape went
+// returns an empty message if the scrape succeeded and a message explaining why if it didn't
+func (action ScrapeAction) scrape(ctx context.Context, probeName string, span *trace.Span) string {
+	now := time.Now()
+	var sampleLabels map[string]string = map[string]string{"probe": probeName}
+	samples, samplesScraped, samplesPostMetricRelabeling, message := action.fetch(ctx, probeName)
+	(*span).SetAttributes(
+		attribute.Int("bunny.scrape.samples_scraped", samplesScraped),
+		attribute.Int("bunny.scrape.samples_post_metric_relabeling", samplesPostMetricRelabeling),
+	)
+	if message == "" && samplesPostMetricRelabeling > action.sampleLimit {
+		message = fmt.Sprintf("probe failed - %v samples is more than the sample limit of %v", samplesPostMetricRelabeling, action.sampleLimit)
+	}
+	// like Prometheus, none of the samples are kept if the scrape fails
+	if message != "" {
+		samples = []telemetry.Sample{}
+	}
+	samples = append(samples,
+		telemetry.Sample{Name: "bunny_scrape_up", Labels: sampleLabels, Value: boolToFloat(message == "")},
+		telemetry.Sample{Name: "bunny_scrape_samples_scraped", Labels: sampleLabels, Value: float64(samplesScraped)},
+		telemetry.Sample{Name: "bunny_scrape_samples_post_metric_relabeling", Labels: sampleLabels, Value: float64(samplesPostMetricRelabeling)},
+		telemetry.Sample{Name: "bunny_scrape_duration_seconds", Labels: sampleLabels, Value: time.Since(now).Seconds()},
+	)
+	appendSamples(samples, now)
+	return message
+}
+
+// returns the samples after relabeling, how many samples there were before and after relabeling, and a message if the scrape failed
+func (action ScrapeAction) fetch(ctx context.Context, probeName string) ([]telemetry.Sample, int, int, string) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, action.url, nil)
+	if err != nil {
+		return nil, 0, 0, "probe failed - could not build request for scrape probe"
+	}
+	request.Close = true // disable keep alives to force creation of new connections on each request
+	request.Header = action.headers
+	response, err := action.client.Do(request)
+	if err != nil {
+		logger.Debug("could not scrape", "url", action.url, "err", err)
+		return nil, 0, 0, "probe failed - no response"
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, 0, fmt.Sprintf("probe failed - http response not ok: %v", response.StatusCode)
+	}
+	// read one more byte than the limit so that we can tell when the body is over it
+	body, err := io.ReadAll(io.LimitReader(response.Body, int64(action.bodySizeLimitBytes)+1))
+	if err != nil {
+		logger.Debug("could not read response body", "url", action.url, "err", err)
+		return nil, 0, 0, "probe failed - could not read response body"
+	}
+	if len(body) > action.bodySizeLimitBytes {
+		return nil, 0, 0, fmt.Sprintf("probe failed - response body is larger than %v bytes", action.bodySizeLimitBytes)
+	}
+
+	// an unknown content type is parsed as the Prometheus text format
+	parser, err := textparse.New(body, response.Header.Get("Content-Type"), false, labels.NewSymbolTable())
+	if err != nil {
+		logger.Debug("could not parse content type", "Content-Type", response.Header.Get("Content-Type"), "err", err)
+	}
+	var samples []telemetry.Sample = []telemetry.Sample{}
+	var samplesScraped int = 0
+	var samplesPostMetricRelabeling int = 0
+	// relabeling can make two series the same, which the TSDB would reject
+	var seen map[string]bool = map[string]bool{}
+	for {
+		entry, err := parser.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logger.Debug("could not parse metrics", "url", action.url, "err", err)
+			return nil, samplesScraped, len(samples), "probe failed - could not parse metrics"
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+		samplesScraped++
+		// timestamps in the exposition are ignored (like honor_timestamps: false) so that they can't be out of order
+		_, _, value := parser.Series()
+		var lbls labels.Labels
+		parser.Metric(&lbls)
+		lbls = addProbeLabel(lbls, probeName)
+		lbls, keep := relabel.Process(lbls, action.metricRelabelConfigs...)
+		if !keep || lbls.Get(labels.MetricName) == "" {
+			continue
+		}
+		key := lbls.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		samplesPostMetricRelabeling++
+		// stop keeping samples once over the limit rather than holding on to a huge scrape
+		if samplesPostMetricRelabeling > action.sampleLimit {
+			continue
+		}
+		samples = append(samples, telemetry.Sample{Name: lbls.Get(labels.MetricName), Labels: lbls.Map(), Value: value})
+	}
+	return samples, samplesScraped, samplesPostMetricRelabeling, ""
+}
+
+// like Prometheus does with the job and instance labels, a probe label from the app is kept as exported_probe
+func addProbeLabel(lbls labels.Labels, probeName string) labels.Labels {
+	builder := labels.NewBuilder(lbls)
+	if existing := lbls.Get("probe"); existing != "" {
+		builder.Set("exported_probe", existing)
+	}
+	builder.Set("probe", probeName)
+	return builder.Labels()
+}
@@ -4,6 +4,7 @@ import (
 	"bunny/config"
 	"bunny/telemetry"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
@@ -13,10 +14,12 @@ import (
 )
 
 type TCPSocketAction struct {
-	host        string
-	port        int
-	expectSteps []ExpectStep
-	timeout     time.Duration
+	host           string
+	port           int
+	unixSocketPath string
+	tlsConfig      *tls.Config
+	expectSteps    []ExpectStep
+	timeout        time.Duration
 }
 
 func newTCPSocketAction(tcpSocketActionConfig *config.TCPSocketActionConfig, timeout time.Duration) *TCPSocketAction {
@@ -29,74 +32,106 @@ func newTCPSocketAction(tcpSocketActionConfig *config.TCPSocketActionConfig, tim
 	if tcpSocketActionConfig.Host != nil && *tcpSocketActionConfig.Host != "" {
 		host = *tcpSocketActionConfig.Host
 	}
+	unixSocketPath, ok := newUnixSocketPath(tcpSocketActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+	// when tls is set, the connection is wrapped in TLS from the start
+	var tlsConfig *tls.Config = nil
+	if tcpSocketActionConfig.TLS != nil {
+		tlsConfig = newTLSConfig(tcpSocketActionConfig.TLS)
+		if tlsConfig == nil {
+			logger.Error("could not process tls for tcp socket probe config")
+			return nil
+		}
+	}
 	var expectSteps []ExpectStep = []ExpectStep{}
 	if tcpSocketActionConfig.Expect != nil {
-		for _, expectStepConfig := range *tcpSocketActionConfig.Expect {
-			var expectStep ExpectStep = newExpectStep(&expectStepConfig)
-			if expectStep != nil {
-				expectSteps = append(expectSteps, expectStep)
-			}
+		var ok bool
+		expectSteps, ok = newExpectSteps(*tcpSocketActionConfig.Expect)
+		if !ok {
+			logger.Error("could not process expect steps for tcp socket probe config")
+			return nil
 		}
 	}
 
 	// we don't create a client for tcp socket connections because it's just a net.Dial() call
 
 	return &TCPSocketAction{
-		host:        host,
-		port:        tcpSocketActionConfig.Port,
-		expectSteps: expectSteps,
-		timeout:     timeout,
+		host:           host,
+		port:           tcpSocketActionConfig.Port,
+		unixSocketPath: unixSocketPath,
+		tlsConfig:      tlsConfig,
+		expectSteps:    expectSteps,
+		timeout:        timeout,
 	}
 }
 
-func (action TCPSocketAction) act(probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) {
+func (action TCPSocketAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
 	logger.Debug("performing tcp socket probe")
-	// need to run this on a separate goroutine since the timeout could be greater than the period
-	go func() {
-		timeoutTime := time.Now().Add(action.timeout)
-		timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(context.Background(), timeoutTime, context.DeadlineExceeded)
-		defer timeoutContextCancelFunc()
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
 
-		// create the span
-		_, span := (*tracer).Start(timeoutContext, "tcp-socket-probe")
-		span.SetAttributes(attribute.KeyValue{
-			Key:   "bunny-probe-name",
-			Value: attribute.StringValue(probeName),
-		})
-		defer span.End()
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "tcp-socket-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
 
-		// connect to the tcp server
-		host := "localhost"
-		if action.host != "" {
-			host = action.host
-		}
-		timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
-		var target = net.JoinHostPort(host, fmt.Sprintf("%v", action.port))
-		timeoutDuration := time.Until(timeoutTime)
-		dialer := newDialer()
-		dialer.Timeout = timeoutDuration
-		tcpConnection, err := dialer.Dial("tcp", target)
+	// connect to the tcp server
+	host := "localhost"
+	if action.host != "" {
+		host = action.host
+	}
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	var network = "tcp"
+	var target = net.JoinHostPort(host, fmt.Sprintf("%v", action.port))
+	if action.unixSocketPath != "" {
+		// the host is still used as the server name for tls
+		network = "unix"
+		target = action.unixSocketPath
+	}
+	timeoutDuration := time.Until(timeoutTime)
+	dialer := newDialer()
+	dialer.Timeout = timeoutDuration
+	tcpConnection, err := dialer.Dial(network, target)
+	if err != nil {
+		message := "probe failed - could not connect to tcp server"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "target", target, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer tcpConnection.Close()
+	tcpConnection.SetDeadline(timeoutTime)
+	if action.tlsConfig != nil {
+		tlsConnection := tls.Client(tcpConnection, tlsConfigForHost(action.tlsConfig, host))
+		err = tlsConnection.HandshakeContext(spanContext)
 		if err != nil {
-			message := "probe failed - could not connect to tcp server"
+			message := "probe failed - tls handshake failed"
 			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
 			logger.Debug(message, "target", target, "err", err)
 			span.SetStatus(codes.Error, message)
-			return
-		}
-		defer tcpConnection.Close()
-		tcpConnection.SetDeadline(timeoutTime)
-		// check the expect steps
-		expectSuccess := expect(&tcpConnection, action.expectSteps, &span)
-		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, expectSuccess)
-		// thanks motivational code
-		if !expectSuccess {
-			message := "probe failed - expect steps failed"
-			logger.Debug(message)
-			span.SetStatus(codes.Error, message)
-			return
+			return false
 		}
-		message := "probe succeeded"
+		addTLSSpanAttributes(&span, tlsConnection.ConnectionState())
+		tcpConnection = tlsConnection
+	}
+	// check the expect steps
+	expectSuccess := expect(spanContext, tcpConnection, host, timeoutTime, action.expectSteps, &span)
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, expectSuccess)
+	// thanks motivational code
+	if !expectSuccess {
+		message := "probe failed - expect steps failed"
 		logger.Debug(message)
-		span.SetStatus(codes.Ok, message)
-	}()
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	message := "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
 }
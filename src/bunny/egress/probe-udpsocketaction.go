@@ -0,0 +1,235 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type UDPSocketAction struct {
+	host      string
+	port      int
+	datagrams []DatagramStep
+	timeout   time.Duration
+}
+
+// either payload or regex is set, depending on if the datagram is sent or received
+type DatagramStep struct {
+	payload  []byte
+	regex    *regexp.Regexp
+	encoding string
+	timeout  time.Duration
+}
+
+// big enough for any datagram that can be received
+const maxDatagramBytes int = 65535
+
+// the largest payload that can be sent in one UDP datagram over IPv4 (65535 less the IP and UDP headers)
+const maxDatagramPayloadBytes int = 65507
+
+func newUDPSocketAction(udpSocketActionConfig *config.UDPSocketActionConfig, timeout time.Duration) *UDPSocketAction {
+	logger.Info("processing udp socket probe config")
+	if udpSocketActionConfig == nil {
+		return nil
+	}
+
+	var host = "localhost"
+	if udpSocketActionConfig.Host != nil && *udpSocketActionConfig.Host != "" {
+		host = *udpSocketActionConfig.Host
+	}
+	var datagrams []DatagramStep = []DatagramStep{}
+	for _, datagramConfig := range udpSocketActionConfig.Expect {
+		datagram := newDatagramStep(&datagramConfig)
+		if datagram == nil {
+			logger.Error("could not process expect steps for udp socket probe config")
+			return nil
+		}
+		datagrams = append(datagrams, *datagram)
+	}
+
+	return &UDPSocketAction{
+		host:      host,
+		port:      udpSocketActionConfig.Port,
+		datagrams: datagrams,
+		timeout:   timeout,
+	}
+}
+
+func newDatagramStep(datagramConfig *config.DatagramConfig) *DatagramStep {
+	if (datagramConfig.Send == nil) == (datagramConfig.Receive == nil) {
+		logger.Error("exactly one of send or receive must be set in each step of a udp socket action")
+		return nil
+	}
+	var timeout time.Duration = 0
+	if datagramConfig.TimeoutMilliseconds != nil {
+		timeout = time.Duration(*datagramConfig.TimeoutMilliseconds) * time.Millisecond
+	}
+	if datagramConfig.Send != nil {
+		encoding, ok := newExpectEncoding(datagramConfig.Send.Encoding)
+		if !ok {
+			return nil
+		}
+		payload, err := decodeExpectText(datagramConfig.Send.Text, encoding)
+		if err != nil {
+			logger.Error("could not decode text for udp send step", "encoding", encoding, "err", err)
+			return nil
+		}
+		if len(payload) > maxDatagramPayloadBytes {
+			logger.Error("text for udp send step is too large for a datagram", "len(payload)", len(payload))
+			return nil
+		}
+		return &DatagramStep{
+			payload:  payload,
+			encoding: encoding,
+			timeout:  timeout,
+		}
+	}
+	encoding, ok := newExpectEncoding(datagramConfig.Receive.Encoding)
+	if !ok {
+		return nil
+	}
+	regex, err := regexp.Compile(datagramConfig.Receive.RegEx)
+	if err != nil {
+		logger.Error("error in regex for udp receive step", "datagramConfig.Receive.RegEx", datagramConfig.Receive.RegEx, "err", err)
+		return nil
+	}
+	return &DatagramStep{
+		regex:    regex,
+		encoding: encoding,
+		timeout:  timeout,
+	}
+}
+
+func (action UDPSocketAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing udp socket probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "udp-socket-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	defer span.End()
+
+	// "connect" the udp socket
+	// nothing is sent by this but it means that we only receive datagrams from the target
+	// and that ICMP port unreachable errors are returned when reading
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	var target = net.JoinHostPort(action.host, fmt.Sprintf("%v", action.port))
+	dialer := newDialer()
+	dialer.Timeout = time.Until(timeoutTime)
+	udpConnection, err := dialer.DialContext(spanContext, "udp", target)
+	if err != nil {
+		message := "probe failed - could not create udp socket"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "target", target, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer udpConnection.Close()
+	udpConnection.SetDeadline(timeoutTime)
+
+	for _, datagram := range action.datagrams {
+		successful := datagram.do(spanContext, udpConnection, timeoutTime)
+		if !successful {
+			message := "probe failed - expect steps failed"
+			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+			logger.Debug(message)
+			span.SetStatus(codes.Error, message)
+			return false
+		}
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message := "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+func (datagram DatagramStep) do(ctx context.Context, udpConnection net.Conn, deadline time.Time) bool {
+	name := "udp-send"
+	if datagram.regex != nil {
+		name = "udp-receive"
+	}
+	_, span := (*tracer).Start(ctx, name)
+	defer span.End()
+
+	// a step can have less time than the whole probe but not more
+	if datagram.timeout > 0 {
+		stepDeadline := time.Now().Add(datagram.timeout)
+		if stepDeadline.After(deadline) {
+			stepDeadline = deadline
+		}
+		udpConnection.SetDeadline(stepDeadline)
+		defer udpConnection.SetDeadline(deadline)
+	}
+
+	var successful bool
+	var err error
+	if datagram.regex == nil {
+		successful, err = datagram.send(udpConnection, &span)
+	} else {
+		successful, err = datagram.receive(udpConnection, &span)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	if !successful {
+		span.SetStatus(codes.Error, "udp step failed")
+		return false
+	}
+	span.SetStatus(codes.Ok, "udp step succeeded")
+	return true
+}
+
+func (datagram DatagramStep) send(udpConnection net.Conn, span *trace.Span) (bool, error) {
+	logger.Debug("udp send step begins")
+	(*span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan(encodeExpectBytes(datagram.payload, datagram.encoding))))
+	// a datagram is either sent whole or not at all
+	bytesWritten, err := udpConnection.Write(datagram.payload)
+	(*span).SetAttributes(attribute.Int("bunny.expect.bytes", bytesWritten))
+	if err != nil {
+		logger.Debug("udp send step fails", "err", err)
+		return false, err
+	}
+	logger.Debug("udp send step succeeds")
+	return true, nil
+}
+
+// datagrams that don't match (like stray or reordered replies) are recorded as events and skipped
+// until one matches or the deadline passes
+func (datagram DatagramStep) receive(udpConnection net.Conn, span *trace.Span) (bool, error) {
+	logger.Debug("udp receive step begins", "datagram.regex.String()", datagram.regex.String())
+	(*span).SetAttributes(attribute.String("bunny.expect.regex", datagram.regex.String()))
+	buffer := make([]byte, maxDatagramBytes)
+	for {
+		bytesRead, err := udpConnection.Read(buffer)
+		if err != nil {
+			logger.Debug("udp receive step fails", "err", err)
+			return false, err
+		}
+		encodedReceived := encodeExpectBytes(buffer[:bytesRead], datagram.encoding)
+		if datagram.regex.Match(encodedReceived) {
+			(*span).SetAttributes(attribute.Int("bunny.expect.bytes", bytesRead))
+			(*span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan(encodedReceived)))
+			logger.Debug("udp receive step succeeds")
+			return true, nil
+		}
+		logger.Debug("udp receive step skips datagram that does not match", "bytesRead", bytesRead)
+		(*span).AddEvent("non-matching datagram", trace.WithAttributes(
+			attribute.Int("bunny.expect.bytes", bytesRead),
+			attribute.String("bunny.expect.text", truncateForSpan(encodedReceived)),
+		))
+	}
+}
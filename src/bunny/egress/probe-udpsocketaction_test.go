@@ -0,0 +1,65 @@
+package egress
+
+import (
+	"bunny/config"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// a UDP server that answers each datagram with a stray datagram and then "pong"
+func startFakeUDPServer(t *testing.T) int {
+	t.Helper()
+	connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	go func() {
+		buffer := make([]byte, maxDatagramBytes)
+		for {
+			_, address, err := connection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			connection.WriteTo([]byte("stray"), address)
+			connection.WriteTo([]byte("pong"), address)
+		}
+	}()
+	return connection.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPSocketAction(t *testing.T) {
+	port := startFakeUDPServer(t)
+	timeout := 200
+	tests := []struct {
+		name    string
+		regex   string
+		success bool
+	}{
+		{name: "first datagram matches", regex: "^stray$", success: true},
+		{name: "later datagram matches", regex: "^pong$", success: true},
+		{name: "no datagram matches", regex: "^ping$", success: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			udpSocketActionConfig := config.UDPSocketActionConfig{
+				Host: stringPointer("127.0.0.1"),
+				Port: port,
+				Expect: []config.DatagramConfig{
+					{Send: &config.DatagramSendConfig{Text: "ping"}},
+					{Receive: &config.DatagramReceiveConfig{RegEx: test.regex}, TimeoutMilliseconds: &timeout},
+				},
+			}
+			action := newUDPSocketAction(&udpSocketActionConfig, time.Second)
+			if action == nil {
+				t.Fatal("could not create udp socket action")
+			}
+			success := action.act(context.Background(), test.name, nil, nil, nil)
+			if success != test.success {
+				t.Errorf("expected success to be %v but it was %v", test.success, success)
+			}
+		})
+	}
+}
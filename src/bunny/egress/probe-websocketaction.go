@@ -0,0 +1,364 @@
+package egress
+
+import (
+	"bunny/config"
+	"bunny/telemetry"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type WebSocketAction struct {
+	url                     string
+	headers                 http.Header
+	dialer                  *websocket.Dialer
+	frames                  []WebSocketFrameStep
+	ping                    bool
+	closeCode               *int
+	closeCodesMetric        *telemetry.LabelledCounterMetric
+	pingRoundTripTimeMetric *telemetry.ResponseTimeMetric
+	timeout                 time.Duration
+}
+
+// either payload or regex is set, depending on if the frame is sent or received
+type WebSocketFrameStep struct {
+	payload     []byte
+	messageType int
+	regex       *regexp.Regexp
+	encoding    string
+	timeout     time.Duration
+}
+
+// the largest message that we'll receive
+const webSocketReadLimitBytes int64 = 1024 * 1024
+
+// used in the closeCodes metric when the server closes the connection without sending a close frame
+const webSocketNoCloseCode int = -1
+
+func newWebSocketAction(webSocketActionConfig *config.WebSocketActionConfig, closeCodesMetricsConfig *config.MetricsConfig, pingRoundTripTimeMetricsConfig *config.MetricsConfig, timeout time.Duration) *WebSocketAction {
+	logger.Info("processing websocket probe config")
+	if webSocketActionConfig == nil {
+		return nil
+	}
+
+	var host = "localhost"
+	if webSocketActionConfig.Host != nil && *webSocketActionConfig.Host != "" {
+		host = *webSocketActionConfig.Host
+	}
+	unixSocketPath, ok := newUnixSocketPath(webSocketActionConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+
+	var scheme = "ws"
+	var tlsConfig *tls.Config = nil
+	if webSocketActionConfig.TLS != nil {
+		scheme = "wss"
+		tlsConfig = newTLSConfig(webSocketActionConfig.TLS)
+		if tlsConfig == nil {
+			return nil
+		}
+	}
+	var url string = fmt.Sprintf("%s://%s:%d/%s", scheme, host, webSocketActionConfig.Port, webSocketActionConfig.Path)
+	if unixSocketPath != "" && webSocketActionConfig.Port == 0 {
+		// the host is still used in the url (and so for the Host header) but the port is meaningless for a unix socket
+		url = fmt.Sprintf("%s://%s/%s", scheme, host, webSocketActionConfig.Path)
+	}
+	logger.Debug("built url", "url", url)
+
+	dialer := &websocket.Dialer{
+		NetDialContext:  newDialer().DialContext,
+		TLSClientConfig: tlsConfig,
+		Subprotocols:    webSocketActionConfig.Subprotocols,
+	}
+	if unixSocketPath != "" {
+		dialer.NetDialContext = newUnixSocketDialContext(unixSocketPath)
+	}
+
+	var headers = http.Header{}
+	for _, httpHeadersConfig := range webSocketActionConfig.HTTPHeaders {
+		headers[httpHeadersConfig.Name] = httpHeadersConfig.Value
+	}
+
+	var frames []WebSocketFrameStep = []WebSocketFrameStep{}
+	for _, frameConfig := range webSocketActionConfig.Expect {
+		frame := newWebSocketFrameStep(&frameConfig)
+		if frame == nil {
+			logger.Error("could not process expect steps for websocket probe config")
+			return nil
+		}
+		frames = append(frames, *frame)
+	}
+
+	return &WebSocketAction{
+		url:                     url,
+		headers:                 headers,
+		dialer:                  dialer,
+		frames:                  frames,
+		ping:                    webSocketActionConfig.Ping,
+		closeCode:               webSocketActionConfig.CloseCode,
+		closeCodesMetric:        telemetry.NewLabelledCounterMetric(closeCodesMetricsConfig, []string{"close_code"}, meter),
+		pingRoundTripTimeMetric: telemetry.NewResponseTimeMetric(pingRoundTripTimeMetricsConfig, meter),
+		timeout:                 timeout,
+	}
+}
+
+func newWebSocketFrameStep(frameConfig *config.WebSocketFrameConfig) *WebSocketFrameStep {
+	if (frameConfig.Send == nil) == (frameConfig.Receive == nil) {
+		logger.Error("exactly one of send or receive must be set in each step of a websocket action")
+		return nil
+	}
+	var timeout time.Duration = 0
+	if frameConfig.TimeoutMilliseconds != nil {
+		timeout = time.Duration(*frameConfig.TimeoutMilliseconds) * time.Millisecond
+	}
+	if frameConfig.Send != nil {
+		encoding, ok := newExpectEncoding(frameConfig.Send.Encoding)
+		if !ok {
+			return nil
+		}
+		payload, err := decodeExpectText(frameConfig.Send.Text, encoding)
+		if err != nil {
+			logger.Error("could not decode text for websocket send step", "encoding", encoding, "err", err)
+			return nil
+		}
+		var messageType = websocket.TextMessage
+		if frameConfig.Send.Binary {
+			messageType = websocket.BinaryMessage
+		}
+		return &WebSocketFrameStep{
+			payload:     payload,
+			messageType: messageType,
+			encoding:    encoding,
+			timeout:     timeout,
+		}
+	}
+	encoding, ok := newExpectEncoding(frameConfig.Receive.Encoding)
+	if !ok {
+		return nil
+	}
+	regex, err := regexp.Compile(frameConfig.Receive.RegEx)
+	if err != nil {
+		logger.Error("error in regex for websocket receive step", "frameConfig.Receive.RegEx", frameConfig.Receive.RegEx, "err", err)
+		return nil
+	}
+	return &WebSocketFrameStep{
+		regex:    regex,
+		encoding: encoding,
+		timeout:  timeout,
+	}
+}
+
+func (action WebSocketAction) act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool {
+	logger.Debug("performing websocket probe")
+	timeoutTime := attemptDeadline(ctx, action.timeout)
+	timeoutContext, timeoutContextCancelFunc := context.WithDeadlineCause(ctx, timeoutTime, context.DeadlineExceeded)
+	defer timeoutContextCancelFunc()
+
+	// create the span
+	spanContext, span := (*tracer).Start(timeoutContext, "websocket-probe")
+	span.SetAttributes(attribute.KeyValue{
+		Key:   "bunny-probe-name",
+		Value: attribute.StringValue(probeName),
+	})
+	span.SetAttributes(attribute.String("url.full", action.url))
+	defer span.End()
+
+	timerStart := telemetry.PreMeasurable(attemptsMetric, responseTimeMetric)
+	connection, response, err := action.dialer.DialContext(spanContext, action.url, action.headers)
+	if response != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	}
+	if err != nil {
+		message := "probe failed - websocket upgrade failed"
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message, "url", action.url, "err", err)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	defer connection.Close()
+	connection.SetReadLimit(webSocketReadLimitBytes)
+	connection.SetReadDeadline(timeoutTime)
+	connection.SetWriteDeadline(timeoutTime)
+	span.SetAttributes(attribute.String("bunny.websocket.subprotocol", connection.Subprotocol()))
+	if tlsConnection, ok := connection.UnderlyingConn().(*tls.Conn); ok {
+		addTLSSpanAttributes(&span, tlsConnection.ConnectionState())
+	}
+
+	for _, frame := range action.frames {
+		successful := frame.do(spanContext, connection, timeoutTime, action.closeCodesMetric)
+		if !successful {
+			message := "probe failed - expect steps failed"
+			telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+			logger.Debug(message)
+			span.SetStatus(codes.Error, message)
+			return false
+		}
+	}
+
+	message := action.close(connection, timeoutTime, &span)
+	if message != "" {
+		telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, false)
+		logger.Debug(message)
+		span.SetStatus(codes.Error, message)
+		return false
+	}
+	telemetry.PostMeasurable(successesMetric, responseTimeMetric, timerStart, true)
+	message = "probe succeeded"
+	logger.Debug(message)
+	span.SetStatus(codes.Ok, message)
+	return true
+}
+
+// sends a ping (if enabled) and then a close frame, and waits for the server's pong and close frame
+// servers answer in order, so the pong is read before the close frame
+// returns an empty message if everything expected was received and a message explaining why if it wasn't
+func (action WebSocketAction) close(connection *websocket.Conn, deadline time.Time, span *trace.Span) string {
+	var pingStart time.Time
+	var pingRoundTripTime *time.Duration = nil
+	if action.ping {
+		connection.SetPongHandler(func(string) error {
+			if pingRoundTripTime == nil {
+				roundTripTime := time.Since(pingStart)
+				pingRoundTripTime = &roundTripTime
+			}
+			return nil
+		})
+		pingStart = time.Now()
+		err := connection.WriteControl(websocket.PingMessage, []byte("bunny"), deadline)
+		if err != nil {
+			logger.Debug("could not send websocket ping", "err", err)
+			return "probe failed - could not send websocket ping"
+		}
+	}
+
+	err := connection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	if err != nil {
+		logger.Debug("could not send websocket close", "err", err)
+		return "probe failed - could not send websocket close"
+	}
+	// throw away any messages that were still on their way until the server's close frame (or an error) arrives
+	for err == nil {
+		var reader io.Reader
+		_, reader, err = connection.NextReader()
+		if err == nil {
+			_, err = io.Copy(io.Discard, reader)
+		}
+	}
+	closeCode := recordWebSocketClose(err, action.closeCodesMetric, span)
+
+	if action.ping {
+		if pingRoundTripTime == nil {
+			return "probe failed - no websocket pong received"
+		}
+		(*span).SetAttributes(attribute.Int64("bunny.websocket.ping.round_trip_time_ms", pingRoundTripTime.Milliseconds()))
+		telemetry.SetResponseTime(action.pingRoundTripTimeMetric, *pingRoundTripTime)
+	}
+	if action.closeCode != nil && closeCode != *action.closeCode {
+		return fmt.Sprintf("probe failed - unexpected websocket close code: %v", closeCode)
+	}
+	return ""
+}
+
+// records the close code from the error returned when reading from a closed connection
+func recordWebSocketClose(err error, closeCodesMetric *telemetry.LabelledCounterMetric, span *trace.Span) int {
+	var closeCode = webSocketNoCloseCode
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		closeCode = closeError.Code
+	} else {
+		logger.Debug("websocket closed without a close frame", "err", err)
+	}
+	(*span).SetAttributes(attribute.Int("bunny.websocket.close.code", closeCode))
+	telemetry.IncLabelledCounter(closeCodesMetric, strconv.Itoa(closeCode))
+	return closeCode
+}
+
+func (frame WebSocketFrameStep) do(ctx context.Context, connection *websocket.Conn, deadline time.Time, closeCodesMetric *telemetry.LabelledCounterMetric) bool {
+	name := "websocket-send"
+	if frame.regex != nil {
+		name = "websocket-receive"
+	}
+	_, span := (*tracer).Start(ctx, name)
+	defer span.End()
+
+	// a step can have less time than the whole probe but not more
+	if frame.timeout > 0 {
+		stepDeadline := time.Now().Add(frame.timeout)
+		if stepDeadline.After(deadline) {
+			stepDeadline = deadline
+		}
+		connection.SetReadDeadline(stepDeadline)
+		connection.SetWriteDeadline(stepDeadline)
+		defer connection.SetReadDeadline(deadline)
+		defer connection.SetWriteDeadline(deadline)
+	}
+
+	var successful bool
+	var err error
+	if frame.regex == nil {
+		successful, err = frame.send(connection, &span)
+	} else {
+		successful, err = frame.receive(connection, &span, closeCodesMetric)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	if !successful {
+		span.SetStatus(codes.Error, "websocket step failed")
+		return false
+	}
+	span.SetStatus(codes.Ok, "websocket step succeeded")
+	return true
+}
+
+func (frame WebSocketFrameStep) send(connection *websocket.Conn, span *trace.Span) (bool, error) {
+	logger.Debug("websocket send step begins")
+	(*span).SetAttributes(
+		attribute.String("bunny.expect.text", truncateForSpan(encodeExpectBytes(frame.payload, frame.encoding))),
+		attribute.Int("bunny.expect.bytes", len(frame.payload)),
+		attribute.Bool("bunny.websocket.binary", frame.messageType == websocket.BinaryMessage),
+	)
+	err := connection.WriteMessage(frame.messageType, frame.payload)
+	if err != nil {
+		logger.Debug("websocket send step fails", "err", err)
+		return false, err
+	}
+	logger.Debug("websocket send step succeeds")
+	return true, nil
+}
+
+func (frame WebSocketFrameStep) receive(connection *websocket.Conn, span *trace.Span, closeCodesMetric *telemetry.LabelledCounterMetric) (bool, error) {
+	logger.Debug("websocket receive step begins", "frame.regex.String()", frame.regex.String())
+	(*span).SetAttributes(attribute.String("bunny.expect.regex", frame.regex.String()))
+	messageType, data, err := connection.ReadMessage()
+	if err != nil {
+		logger.Debug("websocket receive step fails", "err", err)
+		// the server might have closed the connection instead of answering
+		var closeError *websocket.CloseError
+		if errors.As(err, &closeError) {
+			recordWebSocketClose(err, closeCodesMetric, span)
+		}
+		return false, err
+	}
+	(*span).SetAttributes(
+		attribute.Int("bunny.expect.bytes", len(data)),
+		attribute.Bool("bunny.websocket.binary", messageType == websocket.BinaryMessage),
+	)
+	encodedReceived := encodeExpectBytes(data, frame.encoding)
+	(*span).SetAttributes(attribute.String("bunny.expect.text", truncateForSpan(encodedReceived)))
+	result := frame.regex.Match(encodedReceived)
+	logger.Debug("websocket receive step result", "result", result)
+	return result, nil
+}
@@ -3,47 +3,135 @@ package egress
 import (
 	"bunny/config"
 	"bunny/telemetry"
+	"context"
 	"net"
 	"syscall"
 	"time"
 )
 
 type Probe struct {
-	Name               string
-	AttemptsMetric     *telemetry.CounterMetric
-	ResponseTimeMetric *telemetry.ResponseTimeMetric
-	SuccessesMetric    *telemetry.CounterMetric
-	ProbeAction        *ProbeAction
+	Name                      string
+	DependsOn                 []string
+	Timeout                   time.Duration
+	Retries                   int
+	RetryBackoff              time.Duration
+	AttemptsMetric            *telemetry.CounterMetric
+	ResponseTimeMetric        *telemetry.ResponseTimeMetric
+	SuccessesMetric           *telemetry.CounterMetric
+	SkippedDependenciesMetric *telemetry.CounterMetric
+	FirstTrySuccessesMetric   *telemetry.CounterMetric
+	SuccessesAfterRetryMetric *telemetry.CounterMetric
+	RetriesExhaustedMetric    *telemetry.CounterMetric
+	ProbeAction               *ProbeAction
 }
 
 type ProbeAction interface {
-	act(probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric)
+	// makes one attempt at the probe, returning whether it succeeded once it's finished
+	// the attempt's span is a child of any span in ctx, and the attempt stops at ctx's deadline if that's before its own
+	act(ctx context.Context, probeName string, attemptsMetric *telemetry.CounterMetric, responseTimeMetric *telemetry.ResponseTimeMetric, successesMetric *telemetry.CounterMetric) bool
 }
 
+const defaultRetryBackoffMilliseconds int = 100
+
 func newProbe(egressProbeConfig *config.EgressProbeConfig, timeout time.Duration) *Probe {
+	if egressProbeConfig.Retries < 0 {
+		logger.Error("retries must not be negative", "egressProbeConfig.Name", egressProbeConfig.Name)
+		return nil
+	}
+	var retryBackoffMilliseconds int = defaultRetryBackoffMilliseconds
+	if egressProbeConfig.RetryBackoffMilliseconds != nil {
+		if *egressProbeConfig.RetryBackoffMilliseconds <= 0 {
+			logger.Error("retryBackoffMilliseconds must be greater than 0", "egressProbeConfig.Name", egressProbeConfig.Name)
+			return nil
+		}
+		retryBackoffMilliseconds = *egressProbeConfig.RetryBackoffMilliseconds
+	}
+	// each attempt needs some of the timeout, so the backoffs can't take up all of it
+	// (stopping once they do means that a large number of retries can't overflow the doubling backoff)
+	var backoffs time.Duration = 0
+	var backoff time.Duration = time.Duration(retryBackoffMilliseconds) * time.Millisecond
+	for i := 0; i < egressProbeConfig.Retries && backoffs < timeout; i++ {
+		backoffs += backoff
+		backoff *= 2
+	}
+	if backoffs >= timeout {
+		logger.Error("the backoffs between retries take up the whole timeout", "egressProbeConfig.Name", egressProbeConfig.Name)
+		return nil
+	}
 	var probeAction ProbeAction = nil
-	var execAction *ExecAction = newExecAction(egressProbeConfig.Exec, timeout)
+	var cgroupAction *CgroupAction = newCgroupAction(egressProbeConfig.Cgroup, timeout)
+	var dnsAction *DNSAction = newDNSAction(egressProbeConfig.DNS, timeout)
+	var execAction *ExecAction = newExecAction(egressProbeConfig.Exec, egressConfig.ExecAllowlist, &egressProbeConfig.Metrics.ExitCodes, timeout)
+	var fileAction *FileAction = newFileAction(egressProbeConfig.File, timeout)
 	var grpcAction *GRPCAction = newGRPCAction(egressProbeConfig.GRPC, timeout)
 	var httpGetAction *HTTPGetAction = newHTTPGetAction(egressProbeConfig.HTTPGet, timeout)
+	var listenQueueAction *ListenQueueAction = newListenQueueAction(egressProbeConfig.ListenQueue, timeout)
+	var logTailAction *LogTailAction = newLogTailAction(egressProbeConfig.LogTail, timeout)
+	var memcachedAction *MemcachedAction = newMemcachedAction(egressProbeConfig.Memcached, timeout)
+	var postgresAction *PostgresAction = newPostgresAction(egressProbeConfig.Postgres, timeout)
+	var processAction *ProcessAction = newProcessAction(egressProbeConfig.Process, signalsConfig.WatchedProcessCommandLineRegEx, timeout)
+	var redisAction *RedisAction = newRedisAction(egressProbeConfig.Redis, timeout)
+	var scenarioAction *ScenarioAction = newScenarioAction(egressProbeConfig.Scenario, timeout)
+	var scrapeAction *ScrapeAction = newScrapeAction(egressProbeConfig.Scrape, timeout)
 	var tcpSocketAction *TCPSocketAction = newTCPSocketAction(egressProbeConfig.TCPSocket, timeout)
-	if execAction != nil {
+	var udpSocketAction *UDPSocketAction = newUDPSocketAction(egressProbeConfig.UDPSocket, timeout)
+	var webSocketAction *WebSocketAction = newWebSocketAction(egressProbeConfig.WebSocket, &egressProbeConfig.Metrics.CloseCodes, &egressProbeConfig.Metrics.PingRoundTripTime, timeout)
+	if cgroupAction != nil {
+		probeAction = cgroupAction
+	} else if dnsAction != nil {
+		probeAction = dnsAction
+	} else if execAction != nil {
 		probeAction = execAction
+	} else if fileAction != nil {
+		probeAction = fileAction
 	} else if grpcAction != nil {
 		probeAction = grpcAction
 	} else if httpGetAction != nil {
 		probeAction = httpGetAction
+	} else if listenQueueAction != nil {
+		probeAction = listenQueueAction
+	} else if logTailAction != nil {
+		probeAction = logTailAction
+	} else if memcachedAction != nil {
+		probeAction = memcachedAction
+	} else if postgresAction != nil {
+		probeAction = postgresAction
+	} else if processAction != nil {
+		probeAction = processAction
+	} else if redisAction != nil {
+		probeAction = redisAction
+	} else if scenarioAction != nil {
+		probeAction = scenarioAction
+	} else if scrapeAction != nil {
+		probeAction = scrapeAction
 	} else if tcpSocketAction != nil {
 		probeAction = tcpSocketAction
+	} else if udpSocketAction != nil {
+		probeAction = udpSocketAction
+	} else if webSocketAction != nil {
+		probeAction = webSocketAction
 	} else {
 		logger.Error("no action for probe", "egressProbeConfig", egressProbeConfig)
 		return nil
 	}
+	var dependsOn []string = []string{}
+	if egressProbeConfig.DependsOn != nil {
+		dependsOn = egressProbeConfig.DependsOn
+	}
 	return &Probe{
-		Name:               egressProbeConfig.Name,
-		AttemptsMetric:     telemetry.NewCounterMetric(&egressProbeConfig.Metrics.Attempts, meter),
-		ResponseTimeMetric: telemetry.NewResponseTimeMetric(&egressProbeConfig.Metrics.ResponseTime, meter),
-		SuccessesMetric:    telemetry.NewCounterMetric(&egressProbeConfig.Metrics.Successes, meter),
-		ProbeAction:        &probeAction,
+		Name:                      egressProbeConfig.Name,
+		DependsOn:                 dependsOn,
+		Timeout:                   timeout,
+		Retries:                   egressProbeConfig.Retries,
+		RetryBackoff:              time.Duration(retryBackoffMilliseconds) * time.Millisecond,
+		AttemptsMetric:            telemetry.NewCounterMetric(&egressProbeConfig.Metrics.Attempts, meter),
+		ResponseTimeMetric:        telemetry.NewResponseTimeMetric(&egressProbeConfig.Metrics.ResponseTime, meter),
+		SuccessesMetric:           telemetry.NewCounterMetric(&egressProbeConfig.Metrics.Successes, meter),
+		SkippedDependenciesMetric: telemetry.NewCounterMetric(&egressProbeConfig.Metrics.SkippedDependencies, meter),
+		FirstTrySuccessesMetric:   telemetry.NewCounterMetric(&egressProbeConfig.Metrics.FirstTrySuccesses, meter),
+		SuccessesAfterRetryMetric: telemetry.NewCounterMetric(&egressProbeConfig.Metrics.SuccessesAfterRetry, meter),
+		RetriesExhaustedMetric:    telemetry.NewCounterMetric(&egressProbeConfig.Metrics.RetriesExhausted, meter),
+		ProbeAction:               &probeAction,
 	}
 }
 
@@ -58,3 +146,11 @@ func newDialer() *net.Dialer {
 		},
 	}
 }
+
+// records values measured by a probe action in the local TSDB
+func appendSamples(samples []telemetry.Sample, timestamp time.Time) {
+	err := telemetry.AppendSamples(samples, timestamp)
+	if err != nil {
+		logger.Error("could not append samples to the tsdb", "err", err)
+	}
+}
@@ -0,0 +1,131 @@
+package egress
+
+import (
+	"bunny/config"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// where probe actions that speak the protocol of a particular server (like redis) connect to
+type Server struct {
+	host           string
+	port           int
+	unixSocketPath string
+	tlsConfig      *tls.Config
+}
+
+// checks a named field (like a line from redis' INFO or memcached's stats) against a regex
+type FieldAssertion struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+func newServer(serverConfig *config.ServerConfig, defaultPort int) *Server {
+	var host = "localhost"
+	if serverConfig.Host != nil && *serverConfig.Host != "" {
+		host = *serverConfig.Host
+	}
+	var port = defaultPort
+	if serverConfig.Port != nil {
+		port = *serverConfig.Port
+	}
+	unixSocketPath, ok := newUnixSocketPath(serverConfig.UnixSocket)
+	if !ok {
+		return nil
+	}
+	var tlsConfig *tls.Config = nil
+	if serverConfig.TLS != nil {
+		tlsConfig = newTLSConfig(serverConfig.TLS)
+		if tlsConfig == nil {
+			return nil
+		}
+	}
+	return &Server{
+		host:           host,
+		port:           port,
+		unixSocketPath: unixSocketPath,
+		tlsConfig:      tlsConfig,
+	}
+}
+
+// connects to the server without TLS
+func (server Server) dial(ctx context.Context, deadline time.Time, span *trace.Span) (net.Conn, error) {
+	var network = "tcp"
+	var target = net.JoinHostPort(server.host, fmt.Sprintf("%v", server.port))
+	if server.unixSocketPath != "" {
+		network = "unix"
+		target = server.unixSocketPath
+	}
+	(*span).SetAttributes(
+		attribute.String("server.address", target),
+		attribute.String("network.transport", network),
+	)
+	dialer := newDialer()
+	dialer.Timeout = time.Until(deadline)
+	connection, err := dialer.DialContext(ctx, network, target)
+	if err != nil {
+		return nil, err
+	}
+	connection.SetDeadline(deadline)
+	return connection, nil
+}
+
+// wraps the connection in TLS, for servers which start TLS straight away or after being asked to (like postgres)
+func (server Server) handshake(ctx context.Context, connection net.Conn, span *trace.Span) (net.Conn, error) {
+	tlsConnection := tls.Client(connection, tlsConfigForHost(server.tlsConfig, server.host))
+	err := tlsConnection.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addTLSSpanAttributes(span, tlsConnection.ConnectionState())
+	return tlsConnection, nil
+}
+
+// connects to the server, using TLS if it's configured
+func (server Server) connect(ctx context.Context, deadline time.Time, span *trace.Span) (net.Conn, error) {
+	connection, err := server.dial(ctx, deadline, span)
+	if err != nil || server.tlsConfig == nil {
+		return connection, err
+	}
+	tlsConnection, err := server.handshake(ctx, connection, span)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return tlsConnection, nil
+}
+
+func newFieldAssertions(fieldAssertionConfigs []config.FieldAssertionConfig) ([]FieldAssertion, bool) {
+	var assertions []FieldAssertion = []FieldAssertion{}
+	for _, fieldAssertionConfig := range fieldAssertionConfigs {
+		regex, err := regexp.Compile(fieldAssertionConfig.RegEx)
+		if err != nil {
+			logger.Error("error in regex for field", "fieldAssertionConfig.Name", fieldAssertionConfig.Name, "fieldAssertionConfig.RegEx", fieldAssertionConfig.RegEx, "err", err)
+			return nil, false
+		}
+		assertions = append(assertions, FieldAssertion{name: fieldAssertionConfig.Name, regex: regex})
+	}
+	return assertions, true
+}
+
+// returns an empty message if all of the fields match and a message explaining why if they don't
+func checkFieldAssertions(assertions []FieldAssertion, fields map[string]string) string {
+	for _, assertion := range assertions {
+		value, found := fields[assertion.name]
+		if !found {
+			return fmt.Sprintf("probe failed - field not found: %v", assertion.name)
+		}
+		if !assertion.regex.MatchString(value) {
+			logger.Debug("field does not match regex", "name", assertion.name, "value", value, "regex", assertion.regex.String())
+			return fmt.Sprintf("probe failed - field did not match regex: %v", assertion.name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package egress
+
+import (
+	"bunny/config"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// builds the tls.Config for probes that wrap their connection in TLS
+// the server name isn't set here since it defaults to the host being connected to, which may only be known later
+func newTLSConfig(tlsConfig *config.TLSConfig) *tls.Config {
+	if tlsConfig == nil {
+		return nil
+	}
+	newTLSConfig := &tls.Config{
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName != nil {
+		newTLSConfig.ServerName = *tlsConfig.ServerName
+	}
+	if tlsConfig.CAFile != nil && *tlsConfig.CAFile != "" {
+		data, err := os.ReadFile(*tlsConfig.CAFile)
+		if err != nil {
+			logger.Error("could not read caFile for tls config", "tlsConfig.CAFile", *tlsConfig.CAFile, "err", err)
+			return nil
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(data) {
+			logger.Error("no certificates found in caFile for tls config", "tlsConfig.CAFile", *tlsConfig.CAFile)
+			return nil
+		}
+		newTLSConfig.RootCAs = certPool
+	}
+	return newTLSConfig
+}
+
+// returns a copy of the tls.Config with the server name set to the host (unless one was set in the config)
+func tlsConfigForHost(tlsConfig *tls.Config, host string) *tls.Config {
+	hostTLSConfig := tlsConfig.Clone()
+	if hostTLSConfig.ServerName == "" {
+		hostTLSConfig.ServerName = host
+	}
+	return hostTLSConfig
+}
+
+func addTLSSpanAttributes(span *trace.Span, connectionState tls.ConnectionState) {
+	(*span).SetAttributes(
+		attribute.String("tls.protocol.version", tls.VersionName(connectionState.Version)),
+		attribute.String("tls.cipher", tls.CipherSuiteName(connectionState.CipherSuite)),
+		attribute.String("tls.server_name", connectionState.ServerName),
+	)
+}
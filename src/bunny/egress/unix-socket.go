@@ -0,0 +1,34 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+)
+
+// checks the unixSocket path from a probe config
+// like Go's net package (and tools like ss and socat), a leading "@" means the socket is in the abstract namespace,
+// which only exists on Linux
+func newUnixSocketPath(unixSocket *string) (string, bool) {
+	if unixSocket == nil {
+		return "", true
+	}
+	if *unixSocket == "" || *unixSocket == "@" {
+		logger.Error("unixSocket must be set to a path or an abstract name starting with @")
+		return "", false
+	}
+	if strings.HasPrefix(*unixSocket, "@") && runtime.GOOS != "linux" {
+		logger.Error("abstract unix sockets are only supported on linux", "unixSocket", *unixSocket, "runtime.GOOS", runtime.GOOS)
+		return "", false
+	}
+	return *unixSocket, true
+}
+
+// returns a dial function which ignores the address it's given and connects to the unix socket instead
+// so that clients (like http and grpc) can still use a URL or target with a host name in it
+func newUnixSocketDialContext(unixSocketPath string) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return newDialer().DialContext(ctx, "unix", unixSocketPath)
+	}
+}
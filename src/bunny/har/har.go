@@ -0,0 +1,423 @@
+package har
+
+import (
+	"bunny/config"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the parts of a HAR file that are needed to build a scenario
+// see: http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Entries []HAREntry `json:"entries"`
+}
+
+type HAREntry struct {
+	Request  HARRequest  `json:"request"`
+	Response HARResponse `json:"response"`
+	// added by Chrome and Firefox
+	ResourceType string `json:"_resourceType"`
+}
+
+type HARRequest struct {
+	Method   string         `json:"method"`
+	URL      string         `json:"url"`
+	Headers  []HARNameValue `json:"headers"`
+	PostData *HARPostData   `json:"postData"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+}
+
+type HARContent struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ConvertOptions struct {
+	Name string
+	// only requests to this host are kept, defaulting to the host of the first request
+	Host          string
+	IncludeStatic bool
+}
+
+// a value from a response that a later request sends back, like a token
+type TokenSource struct {
+	step     int
+	variable string
+	jsonPath string
+	header   string
+	used     bool
+}
+
+// headers which are about the connection rather than the request, or which the scenario sets itself
+// (cookies are kept in the scenario's cookie jar, and compressed responses aren't decompressed)
+var droppedHeaders map[string]bool = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+	"te":                  true,
+	"trailer":             true,
+	"trailers":            true,
+	"transfer-encoding":   true,
+	"upgrade":             true,
+	"cookie":              true,
+	"host":                true,
+	"content-length":      true,
+	"accept-encoding":     true,
+	"if-none-match":       true,
+	"if-modified-since":   true,
+}
+
+var staticResourceTypes map[string]bool = map[string]bool{
+	"image":      true,
+	"stylesheet": true,
+	"script":     true,
+	"font":       true,
+	"media":      true,
+	"manifest":   true,
+}
+
+var tokenRegEx *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9._~+/=-]{16,}$`)
+var tokenSeparatorRegEx *regexp.Regexp = regexp.MustCompile(`[^A-Za-z0-9._~+/=-]+`)
+var jsonPathKeyRegEx *regexp.Regexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var variableSeparatorRegEx *regexp.Regexp = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// converts the requests in the HAR into a probe with a scenario action
+// also returns notes about what was left out and values that look like they should be variables
+func Convert(har *HAR, options ConvertOptions) (*config.EgressProbeConfig, []string, error) {
+	var notes []string = []string{}
+	if len(har.Log.Entries) == 0 {
+		return nil, notes, errors.New("no entries in HAR")
+	}
+	firstURL, err := url.Parse(har.Log.Entries[0].Request.URL)
+	if err != nil {
+		return nil, notes, fmt.Errorf("could not parse url of first entry: %w", err)
+	}
+	var host string = options.Host
+	if host == "" {
+		host = firstURL.Hostname()
+	}
+
+	scenario := &config.ScenarioActionConfig{Steps: []config.ScenarioStepConfig{}}
+	var scenarioURL *url.URL = nil
+	var tokenSources map[string]*TokenSource = map[string]*TokenSource{}
+	var variables map[string]bool = map[string]bool{}
+	for i := 0; i < len(har.Log.Entries); i++ {
+		entry := har.Log.Entries[i]
+		entryURL, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("skipped entry %d - could not parse url: %v", i+1, err))
+			continue
+		}
+		if entryURL.Hostname() != host {
+			notes = append(notes, fmt.Sprintf("skipped entry %d - %v is not on %v", i+1, entry.Request.URL, host))
+			continue
+		}
+		// requests that the browser never got a response for, and CORS preflights, which the browser makes by itself
+		if entry.Response.Status == 0 || entry.Request.Method == "OPTIONS" {
+			continue
+		}
+		if !options.IncludeStatic && isStatic(&entry) {
+			continue
+		}
+		if scenarioURL == nil {
+			scenarioURL = entryURL
+		} else if entryURL.Scheme != scenarioURL.Scheme || entryURL.Port() != scenarioURL.Port() {
+			notes = append(notes, fmt.Sprintf("skipped entry %d - %v is not on %v", i+1, entry.Request.URL, scenarioURL.Scheme+"://"+scenarioURL.Host))
+			continue
+		}
+
+		// the scenario follows redirects, so the steps for the requests that the browser made to follow them are merged into this one
+		final := entry
+		for final.Response.Status >= 300 && final.Response.Status < 400 && final.Response.RedirectURL != "" && i+1 < len(har.Log.Entries) {
+			redirectURL, err := url.Parse(final.Response.RedirectURL)
+			if err != nil {
+				break
+			}
+			finalURL, _ := url.Parse(final.Request.URL)
+			next := har.Log.Entries[i+1]
+			if finalURL.ResolveReference(redirectURL).String() != next.Request.URL {
+				break
+			}
+			final = next
+			i++
+		}
+
+		step := newStep(&entry, &final, entryURL, len(scenario.Steps))
+		stepNotes := useVariables(&step, scenario, tokenSources, variables)
+		notes = append(notes, stepNotes...)
+		scenario.Steps = append(scenario.Steps, step)
+		addTokenSources(&final, len(scenario.Steps)-1, tokenSources)
+	}
+	if scenarioURL == nil {
+		return nil, notes, fmt.Errorf("no requests to %v in HAR", host)
+	}
+
+	scenarioHost := scenarioURL.Hostname()
+	scenarioScheme := scenarioURL.Scheme
+	scenario.Host = &scenarioHost
+	scenario.Scheme = &scenarioScheme
+	scenario.Port, err = portOf(scenarioURL)
+	if err != nil {
+		return nil, notes, err
+	}
+	return &config.EgressProbeConfig{Name: options.Name, Scenario: scenario}, notes, nil
+}
+
+func isStatic(entry *HAREntry) bool {
+	if staticResourceTypes[entry.ResourceType] {
+		return true
+	}
+	mimeType := mediaType(entry.Response.Content.MimeType)
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "font/") || mimeType == "text/css" || strings.HasSuffix(mimeType, "javascript")
+}
+
+func newStep(entry *HAREntry, final *HAREntry, entryURL *url.URL, index int) config.ScenarioStepConfig {
+	name := stepName(entry.Request.Method, entryURL.Path, index)
+	method := entry.Request.Method
+	path := strings.TrimPrefix(entryURL.EscapedPath(), "/")
+	if entryURL.RawQuery != "" {
+		path = path + "?" + entryURL.RawQuery
+	}
+	step := config.ScenarioStepConfig{
+		Name:              &name,
+		Path:              path,
+		HTTPHeaders:       []config.HTTPHeadersConfig{},
+		ExpectStatusCodes: []int{final.Response.Status},
+		ExpectHeaders:     []config.FieldAssertionConfig{},
+		Extract:           []config.ScenarioExtractConfig{},
+	}
+	if method != "GET" {
+		step.Method = &method
+	}
+	for _, header := range entry.Request.Headers {
+		// HTTP/2 pseudo headers (like ":authority") are in the request line for HTTP/1.1
+		if strings.HasPrefix(header.Name, ":") || droppedHeaders[strings.ToLower(header.Name)] {
+			continue
+		}
+		step.HTTPHeaders = append(step.HTTPHeaders, config.HTTPHeadersConfig{Name: header.Name, Value: []string{header.Value}})
+	}
+	if entry.Request.PostData != nil && entry.Request.PostData.Text != "" {
+		body := entry.Request.PostData.Text
+		step.Body = &body
+	}
+	contentType := mediaType(headerValue(final.Response.Headers, "Content-Type"))
+	if contentType == "" {
+		contentType = mediaType(final.Response.Content.MimeType)
+	}
+	if contentType != "" && final.Response.Status != 204 && final.Response.Status != 304 {
+		step.ExpectHeaders = append(step.ExpectHeaders, config.FieldAssertionConfig{Name: "Content-Type", RegEx: "^" + regexp.QuoteMeta(contentType)})
+	}
+	return step
+}
+
+// like "2-post-api-login"
+func stepName(method string, path string, index int) string {
+	// IDs and tokens in the path would make the name long and hard to read
+	var segments []string = []string{strings.ToLower(method)}
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" && !looksLikeToken(segment) && strings.Trim(segment, "0123456789") != "" {
+			segments = append(segments, strings.ToLower(segment))
+		}
+	}
+	name := strings.Trim(variableSeparatorRegEx.ReplaceAllString(strings.Join(segments, "-"), "-"), "-")
+	if len(name) > 48 {
+		name = strings.TrimRight(name[:48], "-")
+	}
+	return fmt.Sprintf("%d-%v", index+1, name)
+}
+
+// replaces values in the step that an earlier response sent with variables extracted from that response
+// and returns notes about values that look like tokens but weren't in any earlier response
+func useVariables(step *config.ScenarioStepConfig, scenario *config.ScenarioActionConfig, tokenSources map[string]*TokenSource, variables map[string]bool) []string {
+	var notes []string = []string{}
+	// the longest values first so that a token which contains another is replaced whole
+	var values []string = []string{}
+	for value := range tokenSources {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	replace := func(text string, where string) string {
+		if strings.Contains(text, "{{") {
+			notes = append(notes, fmt.Sprintf("step %v: %v has \"{{\", which needs to be escaped as {{\"{{\"}}", *step.Name, where))
+		}
+		for _, value := range values {
+			if !strings.Contains(text, value) {
+				continue
+			}
+			source := tokenSources[value]
+			if !source.used {
+				source.variable = uniqueVariable(source.variable, variables)
+				extract := config.ScenarioExtractConfig{Variable: source.variable}
+				if source.jsonPath != "" {
+					jsonPath := source.jsonPath
+					extract.JSONPath = &jsonPath
+				} else {
+					header := source.header
+					extract.Header = &header
+				}
+				scenario.Steps[source.step].Extract = append(scenario.Steps[source.step].Extract, extract)
+				source.used = true
+			}
+			text = strings.ReplaceAll(text, value, "{{."+source.variable+"}}")
+		}
+		for _, piece := range tokenSeparatorRegEx.Split(text, -1) {
+			if looksLikeToken(piece) {
+				notes = append(notes, fmt.Sprintf("step %v: %v has %q, which looks like a token but isn't in an earlier response - consider a variable", *step.Name, where, piece))
+			}
+		}
+		return text
+	}
+
+	step.Path = replace(step.Path, "path")
+	for i := range step.HTTPHeaders {
+		step.HTTPHeaders[i].Value[0] = replace(step.HTTPHeaders[i].Value[0], step.HTTPHeaders[i].Name+" header")
+	}
+	if step.Body != nil {
+		body := replace(*step.Body, "body")
+		step.Body = &body
+	}
+	return notes
+}
+
+// remembers the values in the response that look like tokens, and where they can be extracted from
+func addTokenSources(entry *HAREntry, step int, tokenSources map[string]*TokenSource) {
+	for _, header := range entry.Response.Headers {
+		// cookies are kept in the scenario's cookie jar
+		if strings.EqualFold(header.Name, "Set-Cookie") || !looksLikeToken(header.Value) {
+			continue
+		}
+		if _, found := tokenSources[header.Value]; !found {
+			tokenSources[header.Value] = &TokenSource{step: step, variable: header.Name, header: header.Name}
+		}
+	}
+	if mediaType(entry.Response.Content.MimeType) != "application/json" && !strings.HasSuffix(mediaType(entry.Response.Content.MimeType), "+json") {
+		return
+	}
+	text := entry.Response.Content.Text
+	if entry.Response.Content.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return
+		}
+		text = string(decoded)
+	}
+	var data interface{}
+	err := json.Unmarshal([]byte(text), &data)
+	if err != nil {
+		return
+	}
+	walkJSON(data, "$", "", func(jsonPath string, key string, value string) {
+		if _, found := tokenSources[value]; !found && looksLikeToken(value) {
+			tokenSources[value] = &TokenSource{step: step, variable: key, jsonPath: jsonPath}
+		}
+	})
+}
+
+// calls found for each string in the JSON with its JSONPath and the name of the key that it's under
+func walkJSON(data interface{}, jsonPath string, key string, found func(jsonPath string, key string, value string)) {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		// sorted so that the same HAR always gives the same config
+		var keys []string = []string{}
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if jsonPathKeyRegEx.MatchString(k) {
+				walkJSON(value[k], jsonPath+"."+k, k, found)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			walkJSON(element, jsonPath+"["+strconv.Itoa(i)+"]", key, found)
+		}
+	case string:
+		found(jsonPath, key, value)
+	}
+}
+
+// long strings of letters and digits, like session IDs, JWTs, and UUIDs
+func looksLikeToken(value string) bool {
+	if len(value) > 4096 || !tokenRegEx.MatchString(value) {
+		return false
+	}
+	return strings.ContainsAny(value, "0123456789") && strings.ContainsAny(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+// variables are used in templates as {{.name}} so they can only have letters, digits, and underscores
+func uniqueVariable(name string, variables map[string]bool) string {
+	name = strings.Trim(variableSeparatorRegEx.ReplaceAllString(name, "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "token" + name
+	}
+	variable := name
+	for i := 2; variables[variable]; i++ {
+		variable = fmt.Sprintf("%v%d", name, i)
+	}
+	variables[variable] = true
+	return variable
+}
+
+func headerValue(headers []HARNameValue, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// without parameters like charset
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func portOf(u *url.URL) (int, error) {
+	if u.Port() != "" {
+		return strconv.Atoi(u.Port())
+	}
+	switch u.Scheme {
+	case "http":
+		return 80, nil
+	case "https":
+		return 443, nil
+	}
+	return 0, fmt.Errorf("unknown scheme %v", u.Scheme)
+}
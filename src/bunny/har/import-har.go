@@ -0,0 +1,120 @@
+package har
+
+import (
+	"bunny/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the subcommand for converting a HAR file, like "bunny import-har session.har > probe.yaml"
+const ImportHARArg string = "import-har"
+
+// this is run in place of Bunny's main() when Bunny is started with ImportHARArg
+// it writes the config to stdout and notes about it to stderr
+func RunImportHAR(args []string) {
+	flags := flag.NewFlagSet(ImportHARArg, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: bunny %v [flags] <file.har | ->\n", ImportHARArg)
+		fmt.Fprintln(flags.Output(), "converts the requests in a HAR file into the config for a scenario probe")
+		flags.PrintDefaults()
+	}
+	var options ConvertOptions
+	flags.StringVar(&options.Name, "name", "har-scenario", "the name of the probe")
+	flags.StringVar(&options.Host, "host", "", "only keep requests to this host (defaults to the host of the first request)")
+	flags.BoolVar(&options.IncludeStatic, "include-static", false, "keep requests for images, stylesheets, scripts, and fonts")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny import-har: could not read HAR:", err)
+		os.Exit(1)
+	}
+	var har HAR
+	err = json.Unmarshal(data, &har)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny import-har: could not parse HAR:", err)
+		os.Exit(1)
+	}
+	probeConfig, notes, err := Convert(&har, options)
+	for _, note := range notes {
+		fmt.Fprintln(os.Stderr, "bunny import-har:", note)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny import-har:", err)
+		os.Exit(1)
+	}
+
+	bunnyConfig := config.BunnyConfig{Egress: config.EgressConfig{Probes: []config.EgressProbeConfig{*probeConfig}}}
+	var node yaml.Node
+	err = node.Encode(bunnyConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny import-har: could not encode config:", err)
+		os.Exit(1)
+	}
+	pruneYAML(&node)
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bunny import-har: could not write config:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// removes the keys whose values are null, empty, or zero so that only what was set is written
+// (for the config written here, leaving these keys out is the same as setting them to their zero values)
+// returns whether the node itself is empty
+func pruneYAML(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			pruneYAML(child)
+		}
+		return false
+	case yaml.MappingNode:
+		var content []*yaml.Node = []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneYAML(node.Content[i+1]) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			pruneYAML(child)
+		}
+		return len(node.Content) == 0
+	case yaml.ScalarNode:
+		switch node.Tag {
+		case "!!null":
+			return true
+		case "!!bool":
+			return node.Value == "false"
+		case "!!int":
+			return node.Value == "0"
+		case "!!str":
+			return node.Value == ""
+		}
+	}
+	return false
+}
@@ -26,6 +26,7 @@ var ingressConfig *config.IngressConfig = nil
 var meter *metric.Meter = nil
 var httpServer *http.Server = nil
 var healthEndpoints [](*HealthEndpoint) = [](*HealthEndpoint){}
+var pushEndpoint *PushEndpoint = nil
 
 func GoIngress(wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -69,6 +70,17 @@ func GoIngress(wg *sync.WaitGroup) {
 				healthEndpoints = append(healthEndpoints, healthEndpoint)
 			}
 
+			// process config for push endpoints
+			pushEndpoint = nil
+			if ingressConfig.HTTPServerConfig.Push != nil {
+				newPushEndpoint, err := newPushEndpoint(ingressConfig.HTTPServerConfig.Push)
+				if err != nil {
+					logger.Error("error while processing config for push endpoints", "err", err)
+				} else {
+					pushEndpoint = newPushEndpoint
+				}
+			}
+
 			shutdownHTTPServer()
 			startHTTPServer()
 
@@ -108,6 +120,21 @@ func startHTTPServer() {
 		mux.HandleFunc(ensureLeadingSlash(healthConfig.Path), healthEndpointHandler)
 	}
 
+	// Push endpoints handlers
+	if pushEndpoint != nil {
+		if pushEndpoint.RemoteWritePath != "" {
+			mux.HandleFunc(pushEndpoint.RemoteWritePath, pushEndpoint.remoteWriteHandler)
+		}
+		if pushEndpoint.JSONPath != "" {
+			mux.HandleFunc(pushEndpoint.JSONPath, pushEndpoint.jsonHandler)
+		}
+	}
+
+	// Probe graph handler
+	if ingressConfig.HTTPServerConfig.ProbeGraphPath != "" {
+		mux.HandleFunc(ensureLeadingSlash(ingressConfig.HTTPServerConfig.ProbeGraphPath), probeGraphHandler)
+	}
+
 	// OpenTelemetry metrics handler
 	mux.Handle(ensureLeadingSlash(ingressConfig.HTTPServerConfig.OpenTelemetryMetricsPath), promhttp.Handler())
 
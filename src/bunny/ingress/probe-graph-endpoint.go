@@ -0,0 +1,30 @@
+package ingress
+
+import (
+	"bunny/common"
+	"encoding/json"
+	"net/http"
+)
+
+type ProbeGraphResponse struct {
+	Probes []common.ProbeGraphNode `json:"probes"`
+}
+
+// serves the egress probes, the probes that each depends on, and how each went the last time it ran
+func probeGraphHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	common.ProbeGraphMutex.Lock()
+	data, err := json.Marshal(ProbeGraphResponse{Probes: common.ProbeGraph})
+	common.ProbeGraphMutex.Unlock()
+	if err != nil {
+		logger.Error("could not marshal probe graph", "err", err)
+		http.Error(w, "could not marshal probe graph", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
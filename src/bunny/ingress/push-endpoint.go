@@ -0,0 +1,258 @@
+package ingress
+
+import (
+	"bunny/common"
+	"bunny/config"
+	"bunny/telemetry"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// lets the app push samples straight into the local TSDB, either with Prometheus remote write or as JSON
+type PushEndpoint struct {
+	RemoteWritePath string
+	JSONPath        string
+	bearerToken     *config.SecretConfig
+	maxSeries       int
+	maxBodyBytes    int
+}
+
+// a gauge pushed to the JSON endpoint
+type PushedJSONSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value"`
+}
+
+// when each series was last pushed, which is kept across config reloads since the series are still in the TSDB
+// series that haven't been pushed for longer than they can stay in the head of the TSDB are forgotten
+type PushedSeries struct {
+	mutex  sync.Mutex
+	series map[string]time.Time
+}
+
+var pushedSeries *PushedSeries = &PushedSeries{series: map[string]time.Time{}}
+
+// each series is held in memory in the head of the local TSDB, so this stops an app from pushing Bunny past GOMEMLIMIT
+const defaultPushMaxSeries int = 1000
+
+const defaultPushMaxBodyBytes int = 1024 * 1024
+
+func newPushEndpoint(pushConfig *config.PushConfig) (*PushEndpoint, error) {
+	if pushConfig.RemoteWritePath == "" && pushConfig.JSONPath == "" {
+		return nil, errors.New("neither remoteWritePath nor jsonPath set for push")
+	}
+	// the ingress server listens on every interface, so anything that can reach the pod could push without this
+	if pushConfig.BearerToken == nil {
+		return nil, errors.New("bearerToken must be set for push")
+	}
+	var maxSeries int = defaultPushMaxSeries
+	if pushConfig.MaxSeries != nil {
+		if *pushConfig.MaxSeries <= 0 {
+			return nil, errors.New("maxSeries must be greater than 0 for push")
+		}
+		maxSeries = *pushConfig.MaxSeries
+	}
+	var maxBodyBytes int = defaultPushMaxBodyBytes
+	if pushConfig.MaxBodyBytes != nil {
+		if *pushConfig.MaxBodyBytes <= 0 {
+			return nil, errors.New("maxBodyBytes must be greater than 0 for push")
+		}
+		maxBodyBytes = *pushConfig.MaxBodyBytes
+	}
+	var remoteWritePath string = ""
+	if pushConfig.RemoteWritePath != "" {
+		remoteWritePath = ensureLeadingSlash(pushConfig.RemoteWritePath)
+	}
+	var jsonPath string = ""
+	if pushConfig.JSONPath != "" {
+		jsonPath = ensureLeadingSlash(pushConfig.JSONPath)
+	}
+	return &PushEndpoint{
+		RemoteWritePath: remoteWritePath,
+		JSONPath:        jsonPath,
+		bearerToken:     pushConfig.BearerToken,
+		maxSeries:       maxSeries,
+		maxBodyBytes:    maxBodyBytes,
+	}, nil
+}
+
+// handles Prometheus remote write (v1) requests, which are snappy compressed protobuf
+// see: https://prometheus.io/docs/specs/remote_write_spec/
+func (endpoint *PushEndpoint) remoteWriteHandler(w http.ResponseWriter, req *http.Request) {
+	body, ok := endpoint.readBody(w, req)
+	if !ok {
+		return
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		logger.Debug("could not decompress remote write request", "err", err)
+		http.Error(w, "could not decompress request", http.StatusBadRequest)
+		return
+	}
+	var writeRequest prompb.WriteRequest
+	err = writeRequest.Unmarshal(decoded)
+	if err != nil {
+		logger.Debug("could not unmarshal remote write request", "err", err)
+		http.Error(w, "could not unmarshal request", http.StatusBadRequest)
+		return
+	}
+
+	var samples []telemetry.Sample = []telemetry.Sample{}
+	for _, timeSeries := range writeRequest.Timeseries {
+		var sampleLabels map[string]string = map[string]string{}
+		for _, label := range timeSeries.Labels {
+			sampleLabels[label.Name] = label.Value
+		}
+		name := sampleLabels[labels.MetricName]
+		delete(sampleLabels, labels.MetricName)
+		err = validatePushedSeries(name, sampleLabels)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// native histograms and exemplars aren't supported, so they're dropped
+		for _, sample := range timeSeries.Samples {
+			timestamp := time.UnixMilli(sample.Timestamp)
+			samples = append(samples, telemetry.Sample{Name: name, Labels: sampleLabels, Value: sample.Value, Timestamp: &timestamp})
+		}
+	}
+	if !endpoint.appendSamples(w, samples) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handles a single gauge, like {"name": "app_load_factor", "labels": {"queue": "orders"}, "value": 0.7}
+func (endpoint *PushEndpoint) jsonHandler(w http.ResponseWriter, req *http.Request) {
+	body, ok := endpoint.readBody(w, req)
+	if !ok {
+		return
+	}
+	var pushedJSONSample PushedJSONSample
+	err := json.Unmarshal(body, &pushedJSONSample)
+	if err != nil {
+		logger.Debug("could not unmarshal json push request", "err", err)
+		http.Error(w, "could not unmarshal request", http.StatusBadRequest)
+		return
+	}
+	if pushedJSONSample.Value == nil {
+		http.Error(w, "value must be set", http.StatusBadRequest)
+		return
+	}
+	if pushedJSONSample.Labels == nil {
+		pushedJSONSample.Labels = map[string]string{}
+	}
+	err = validatePushedSeries(pushedJSONSample.Name, pushedJSONSample.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples := []telemetry.Sample{{Name: pushedJSONSample.Name, Labels: pushedJSONSample.Labels, Value: *pushedJSONSample.Value}}
+	if !endpoint.appendSamples(w, samples) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checks the method and the bearer token, and then reads the body
+// writes the response and returns false if the request can't go any further
+func (endpoint *PushEndpoint) readBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	bearerToken, err := common.ReadSecret(endpoint.bearerToken)
+	if err != nil {
+		logger.Error("could not read bearer token for push", "err", err)
+		http.Error(w, "could not read bearer token", http.StatusInternalServerError)
+		return nil, false
+	}
+	requestToken, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || bearerToken == "" || subtle.ConstantTimeCompare([]byte(requestToken), []byte(bearerToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	// read one more byte than the limit so that we can tell when the body is over it
+	body, err := io.ReadAll(io.LimitReader(req.Body, int64(endpoint.maxBodyBytes)+1))
+	if err != nil {
+		logger.Debug("could not read push request", "err", err)
+		http.Error(w, "could not read request", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(body) > endpoint.maxBodyBytes {
+		http.Error(w, fmt.Sprintf("request is larger than %v bytes", endpoint.maxBodyBytes), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return body, true
+}
+
+// appends either all of the samples or none of them, and none of them if they'd take the active series over maxSeries
+// writes the response and returns false if they weren't appended
+func (endpoint *PushEndpoint) appendSamples(w http.ResponseWriter, samples []telemetry.Sample) bool {
+	pushedSeries.mutex.Lock()
+	defer pushedSeries.mutex.Unlock()
+
+	now := time.Now()
+	expiry := now.Add(-telemetry.HeadSeriesLifetime())
+	for key, lastPushed := range pushedSeries.series {
+		if lastPushed.Before(expiry) {
+			delete(pushedSeries.series, key)
+		}
+	}
+	var keys map[string]bool = map[string]bool{}
+	var newSeries int = 0
+	for _, sample := range samples {
+		m := map[string]string{labels.MetricName: sample.Name}
+		for name, value := range sample.Labels {
+			m[name] = value
+		}
+		key := labels.FromMap(m).String()
+		if _, found := pushedSeries.series[key]; !found && !keys[key] {
+			newSeries++
+		}
+		keys[key] = true
+	}
+	// a 4xx other than 429 tells Prometheus remote write senders not to retry
+	if len(pushedSeries.series)+newSeries > endpoint.maxSeries {
+		logger.Warn("pushed series would be over maxSeries", "maxSeries", endpoint.maxSeries, "newSeries", newSeries)
+		http.Error(w, fmt.Sprintf("more than %v active series have been pushed", endpoint.maxSeries), http.StatusBadRequest)
+		return false
+	}
+	err := telemetry.AppendSamples(samples, now)
+	if err != nil {
+		// like samples that are out of order or too old
+		logger.Debug("could not append pushed samples to the tsdb", "err", err)
+		http.Error(w, "could not append samples: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	for key := range keys {
+		pushedSeries.series[key] = now
+	}
+	return true
+}
+
+func validatePushedSeries(name string, sampleLabels map[string]string) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("%q is not a valid metric name", name)
+	}
+	for labelName := range sampleLabels {
+		if !model.LabelName(labelName).IsValid() || strings.HasPrefix(labelName, "__") {
+			return fmt.Errorf("%q is not a valid label name", labelName)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bunny/config"
 	"bunny/egress"
+	"bunny/har"
 	"bunny/ingress"
 	"bunny/logging"
 	"bunny/signals"
@@ -14,6 +15,14 @@ import (
 )
 
 func main() {
+	// Bunny runs itself to set rlimits for exec probes, in which case it only needs to start the probe's program
+	if len(os.Args) > 1 && os.Args[1] == egress.ExecSandboxArg {
+		egress.RunExecSandbox(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == har.ImportHARArg {
+		har.RunImportHAR(os.Args[2:])
+	}
+
 	var logger *slog.Logger = logging.ConfigureLogger("main")
 	// this implies that dependencies which still use log instead of slog, use the logger for main
 	slog.SetDefault(logger)
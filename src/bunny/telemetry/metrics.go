@@ -8,6 +8,7 @@ import (
 	"time"
 
 	client_golang_prometheus "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
@@ -24,6 +25,14 @@ type ResponseTimeMetric struct {
 	PromGauge           client_golang_prometheus.Gauge
 }
 
+// a counter where some of the labels are only known when it's incremented (like the exit code of a program)
+type LabelledCounterMetric struct {
+	OtelCounter         *metric.Int64Counter
+	OtelExtraAttributes []attribute.KeyValue
+	LabelNames          []string
+	PromCounterVec      *client_golang_prometheus.CounterVec
+}
+
 func PreMeasurable(attemptsMetric *CounterMetric, responseTimeMetric *ResponseTimeMetric) *time.Time {
 	if attemptsMetric != nil {
 		counter := attemptsMetric.OtelCounter
@@ -43,14 +52,7 @@ func PostMeasurable(successesMetric *CounterMetric, responseTimeMetric *Response
 	}
 	if responseTimeMetric != nil {
 		timerEnd := time.Now()
-		responseTime := timerEnd.Sub(*timerStart)
-
-		common.ResponseTimesMutex.Lock()
-		defer common.ResponseTimesMutex.Unlock()
-		common.ResponseTimes[responseTimeMetric.OtelMetricName] = &responseTime
-
-		// unlike with OpenTelemetry, we can append the value to the Prometheus TSDB immediately
-		responseTimeMetric.PromGauge.Set(float64(responseTime.Milliseconds()))
+		SetResponseTime(responseTimeMetric, timerEnd.Sub(*timerStart))
 	}
 	if successesMetric != nil {
 		counter := successesMetric.OtelCounter
@@ -59,6 +61,29 @@ func PostMeasurable(successesMetric *CounterMetric, responseTimeMetric *Response
 	}
 }
 
+// for counters that aren't incremented by PreMeasurable and PostMeasurable (like probes skipped because of a dependency)
+func IncCounter(counterMetric *CounterMetric) {
+	if counterMetric == nil {
+		return
+	}
+	counter := counterMetric.OtelCounter
+	(*counter).Add(context.Background(), 1, counterMetric.OtelExtraAttributes)
+	counterMetric.PromCounter.Inc()
+}
+
+// for times measured by the probe action itself (like a ping's round trip time) rather than by PreMeasurable and PostMeasurable
+func SetResponseTime(responseTimeMetric *ResponseTimeMetric, responseTime time.Duration) {
+	if responseTimeMetric == nil {
+		return
+	}
+	common.ResponseTimesMutex.Lock()
+	defer common.ResponseTimesMutex.Unlock()
+	common.ResponseTimes[responseTimeMetric.OtelMetricName] = &responseTime
+
+	// unlike with OpenTelemetry, we can append the value to the Prometheus TSDB immediately
+	responseTimeMetric.PromGauge.Set(float64(responseTime.Milliseconds()))
+}
+
 func NewCounterMetric(metricsConfig *config.MetricsConfig, meter *metric.Meter) *CounterMetric {
 	if !metricsConfig.Enabled {
 		return nil
@@ -128,3 +153,50 @@ func NewResponseTimeMetric(metricsConfig *config.MetricsConfig, meter *metric.Me
 		OtelMetricName:      metricName,
 	}
 }
+
+func NewLabelledCounterMetric(metricsConfig *config.MetricsConfig, labelNames []string, meter *metric.Meter) *LabelledCounterMetric {
+	if !metricsConfig.Enabled {
+		return nil
+	}
+
+	var metricName string = metricsConfig.Name
+	newCounter, err := (*meter).Int64Counter("otel_" + metricName)
+	if err != nil {
+		logger.Error("could not create Int64Counter", "err", err)
+		return nil
+	}
+
+	extraAttributes := make([]attribute.KeyValue, len(metricsConfig.ExtraLabels))
+	for i, extraLabelConfig := range metricsConfig.ExtraLabels {
+		extraAttributes[i] = attribute.Key(extraLabelConfig.Name).String(extraLabelConfig.Value)
+	}
+
+	var opts client_golang_prometheus.CounterOpts = client_golang_prometheus.CounterOpts{
+		Name:        "prom_" + metricName,
+		ConstLabels: NewLabels(metricsConfig.ExtraLabels),
+	}
+	var newPromCounterVec = client_golang_prometheus.NewCounterVec(opts, labelNames)
+	PromRegistry.Unregister(newPromCounterVec)
+	PromRegistry.MustRegister(newPromCounterVec)
+
+	return &LabelledCounterMetric{
+		OtelCounter:         &newCounter,
+		OtelExtraAttributes: extraAttributes,
+		LabelNames:          labelNames,
+		PromCounterVec:      newPromCounterVec,
+	}
+}
+
+// the label values must be in the same order as the label names used to create the metric
+func IncLabelledCounter(labelledCounterMetric *LabelledCounterMetric, labelValues ...string) {
+	if labelledCounterMetric == nil {
+		return
+	}
+	attributes := append([]attribute.KeyValue{}, labelledCounterMetric.OtelExtraAttributes...)
+	for i, labelName := range labelledCounterMetric.LabelNames {
+		attributes = append(attributes, attribute.Key(labelName).String(labelValues[i]))
+	}
+	counter := labelledCounterMetric.OtelCounter
+	(*counter).Add(context.Background(), 1, metric.WithAttributeSet(attribute.NewSet(attributes...)))
+	labelledCounterMetric.PromCounterVec.WithLabelValues(labelValues...).Inc()
+}
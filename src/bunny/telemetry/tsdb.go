@@ -0,0 +1,56 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// a value measured by a probe (like the age of a file) or pushed by the app, which is appended straight to the local TSDB
+// so that the health queries of the ingress server can trend it
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// when the value was measured, if it's different to the timestamp passed to AppendSamples (like for pushed samples)
+	Timestamp *time.Time
+}
+
+// appends the samples to the local TSDB with the same timestamp (unless they have their own), either all of them or none of them
+func AppendSamples(samples []Sample, timestamp time.Time) error {
+	if promDB == nil {
+		return errors.New("the tsdb isn't open")
+	}
+	appender := promDB.Appender(context.Background())
+	for _, sample := range samples {
+		var m map[string]string = map[string]string{}
+		for name, value := range sample.Labels {
+			m[name] = value
+		}
+		m[labels.MetricName] = sample.Name
+		var sampleTimestamp time.Time = timestamp
+		if sample.Timestamp != nil {
+			sampleTimestamp = *sample.Timestamp
+		}
+		_, err := appender.Append(0, labels.FromMap(m), sampleTimestamp.UnixMilli(), sample.Value)
+		if err != nil {
+			appender.Rollback()
+			return err
+		}
+	}
+	return appender.Commit()
+}
+
+// how long a series that isn't appended to any more can stay in the head of the local TSDB (and so in memory)
+// the head is compacted into a block once it spans one and a half times the min block duration,
+// and the series that have no samples left in the head are dropped then
+func HeadSeriesLifetime() time.Duration {
+	var minBlockDuration int64 = tsdb.DefaultBlockDuration
+	if telemetryConfig != nil && telemetryConfig.Prometheus.TSDBOptions.MinBlockDurationMilliseconds > 0 {
+		minBlockDuration = int64(telemetryConfig.Prometheus.TSDBOptions.MinBlockDurationMilliseconds)
+	}
+	return 2 * time.Duration(minBlockDuration) * time.Millisecond
+}